@@ -0,0 +1,450 @@
+package gormbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/callbacks"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+type actorKey struct{}
+
+// WithActor records actor as the author of the changes issued with ctx, see OptionAudit.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+func ActorFrom(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorKey{}).(string); ok {
+		return actor
+	}
+	return ""
+}
+
+type AuditChange struct {
+	Column string      `json:"column"`
+	Old    interface{} `json:"old,omitempty"`
+	New    interface{} `json:"new,omitempty"`
+}
+
+// AuditRecord is one change of an audited table, one record per row changed. PrimaryKey is empty for updates
+// and deletes of more than auditMaxRows rows, a single record tells how many rows they changed.
+type AuditRecord struct {
+	Table        string        `json:"table"`
+	Action       string        `json:"action"`
+	PrimaryKey   string        `json:"primary_key"`
+	Changes      []AuditChange `json:"changes"`
+	RowsAffected int64         `json:"rows_affected"`
+	Actor        string        `json:"actor"`
+	Operation    string        `json:"operation"`
+	TraceID      string        `json:"trace_id"`
+	Time         time.Time     `json:"time"`
+}
+
+type AuditSink interface {
+	Audit(ctx context.Context, records ...*AuditRecord) error
+}
+
+type auditLoggerSink struct {
+	logger *zap.Logger
+}
+
+// NewAuditLoggerSink writes every record as an info entry of logger.
+func NewAuditLoggerSink(logger *zap.Logger) AuditSink {
+	return &auditLoggerSink{logger: logger}
+}
+
+func (s *auditLoggerSink) Audit(ctx context.Context, records ...*AuditRecord) error {
+	for _, record := range records {
+		s.logger.Info("gormbox audit",
+			zap.String("db.table", record.Table),
+			zap.String("audit.action", record.Action),
+			zap.String("audit.primary_key", record.PrimaryKey),
+			zap.Any("audit.changes", record.Changes),
+			zap.Int64("audit.rows_affected", record.RowsAffected),
+			zap.String("audit.actor", record.Actor),
+			zap.String("db.operation", record.Operation),
+			zap.String("trace_id", record.TraceID),
+		)
+	}
+	return nil
+}
+
+type auditChanSink struct {
+	ch chan<- *AuditRecord
+}
+
+// NewAuditChanSink sends every record to ch, the statement waits until ch takes it or its ctx is done.
+func NewAuditChanSink(ch chan<- *AuditRecord) AuditSink {
+	return &auditChanSink{ch: ch}
+}
+
+func (s *auditChanSink) Audit(ctx context.Context, records ...*AuditRecord) error {
+	for _, record := range records {
+		select {
+		case s.ch <- record:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// AuditRow is the row written by the table sink, the table can be created with db.Table(table).AutoMigrate(&AuditRow{}).
+type AuditRow struct {
+	ID           int64  `gorm:"primaryKey"`
+	TableName    string `gorm:"column:table_name;size:64;index"`
+	Action       string `gorm:"size:16"`
+	PrimaryKey   string `gorm:"size:191;index"`
+	Changes      string `gorm:"type:text"`
+	RowsAffected int64
+	Actor        string    `gorm:"size:191"`
+	Operation    string    `gorm:"size:191"`
+	TraceID      string    `gorm:"size:32"`
+	CreatedAt    time.Time `gorm:"index"`
+}
+
+type auditTableSink struct {
+	db    *gorm.DB
+	table string
+}
+
+// NewAuditTableSink inserts every record into table through db. The insert is not part of the audited
+// statement's transaction, it follows its commit, don't audit table itself.
+func NewAuditTableSink(db *gorm.DB, table string) AuditSink {
+	return &auditTableSink{db: db, table: table}
+}
+
+func (s *auditTableSink) Audit(ctx context.Context, records ...*AuditRecord) error {
+	rows := make([]*AuditRow, 0, len(records))
+	for _, record := range records {
+		changes, err := json.Marshal(record.Changes)
+		if err != nil {
+			return err
+		}
+		rows = append(rows, &AuditRow{
+			TableName:    record.Table,
+			Action:       record.Action,
+			PrimaryKey:   record.PrimaryKey,
+			Changes:      string(changes),
+			RowsAffected: record.RowsAffected,
+			Actor:        record.Actor,
+			Operation:    record.Operation,
+			TraceID:      record.TraceID,
+			CreatedAt:    record.Time,
+		})
+	}
+	return s.db.WithContext(ctx).Table(s.table).Create(&rows).Error
+}
+
+// InterceptorAudit hands the creates, updates and deletes of tables to sink once they succeeded, once their
+// transaction committed when they run in one, see OptionAudit.
+// The old values of updates and deletes are the rows read right before the statement, under its conditions
+// and through its connection, i.e. within its transaction, from the primary and past the cache.
+// A failing sink is logged, the statement has already been executed.
+func InterceptorAudit(dsn *DSN, logger *zap.Logger, sink AuditSink, tables ...string) Interceptor {
+	audited := make(map[string]struct{}, len(tables))
+	for _, table := range tables {
+		audited[table] = struct{}{}
+	}
+
+	return func(action string, next Handler) Handler {
+		var kind string
+		switch action {
+		case "gorm:create":
+			kind = "create"
+		case "gorm:update":
+			kind = "update"
+		case "gorm:delete":
+			kind = "delete"
+		default:
+			return next
+		}
+
+		return func(db *gorm.DB) {
+			table := db.Statement.Table
+			if _, ok := audited[table]; !ok || db.Error != nil || db.DryRun {
+				next(db)
+				return
+			}
+
+			var olds []map[string]interface{}
+			if kind != "create" {
+				var err error
+				if olds, err = auditLoad(db); err != nil {
+					logger.Error("gormbox audit load error",
+						zap.String("db.connection_string", dsn.Addr),
+						zap.String("db.table", table),
+						zap.String("exception_msg", err.Error()),
+						zap.String("exception_type", "gorm"),
+					)
+				}
+			}
+			var set clause.Set
+			if kind == "update" {
+				var restore func()
+				set, restore = auditSet(db.Statement)
+				defer restore()
+			}
+
+			next(db)
+
+			if db.Error != nil {
+				return
+			}
+			ctx := db.Statement.Context
+			if ctx == nil {
+				ctx = context.Background()
+			}
+
+			var records []*AuditRecord
+			switch kind {
+			case "create":
+				records = auditCreated(db)
+			case "update":
+				records = auditUpdated(db, set, olds)
+			case "delete":
+				records = auditDeleted(db, olds)
+			}
+			now := time.Now()
+			for _, record := range records {
+				record.Table, record.Action, record.Time = table, kind, now
+				record.Actor, record.Operation = ActorFrom(ctx), OperationFrom(ctx)
+				if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+					record.TraceID = sc.TraceID().String()
+				}
+			}
+
+			deliver := func() {
+				if err := sink.Audit(ctx, records...); err != nil {
+					logger.Error("gormbox audit error",
+						zap.String("db.connection_string", dsn.Addr),
+						zap.String("db.table", table),
+						zap.String("exception_msg", err.Error()),
+						zap.String("exception_type", "gorm"),
+					)
+				}
+			}
+			// a rolled back change is not audited
+			if !afterCommit(db, deliver) {
+				deliver()
+			}
+		}
+	}
+}
+
+// auditSet returns the assignments of an update, converting them into its SET clause when it has none yet
+// so that gorm:update writes the very same values. restore drops the clause it added.
+func auditSet(stmt *gorm.Statement) (set clause.Set, restore func()) {
+	if c, ok := stmt.Clauses["SET"]; ok {
+		set, _ = c.Expression.(clause.Set)
+		return set, func() {}
+	}
+	if set = callbacks.ConvertToAssignments(stmt); stmt.Error != nil || len(set) == 0 {
+		return nil, func() {}
+	}
+	stmt.AddClause(set)
+	return set, func() { delete(stmt.Clauses, "SET") }
+}
+
+// auditMaxRows bounds the rows loaded for the old values of an update or a delete
+const auditMaxRows = 1000
+
+// auditLoad reads the rows an update or a delete is about to change, nil when it can't tell them:
+// raw sql, no conditions or more than auditMaxRows rows.
+func auditLoad(db *gorm.DB) ([]map[string]interface{}, error) {
+	stmt := db.Statement
+	if stmt.Schema == nil || stmt.SQL.Len() > 0 {
+		return nil, nil
+	}
+	var exprs []clause.Expression
+	if c, ok := stmt.Clauses["WHERE"]; ok {
+		if where, ok := c.Expression.(clause.Where); ok {
+			exprs = append(exprs, where.Exprs...)
+		}
+	}
+	// gorm adds the primary key of the model to the conditions
+	if stmt.ReflectValue.IsValid() && len(stmt.Schema.PrimaryFields) > 0 {
+		if _, values := schema.GetIdentityFieldValuesMap(stmt.Context, stmt.ReflectValue, stmt.Schema.PrimaryFields); len(values) > 0 {
+			column, values := schema.ToQueryValues(clause.CurrentTable, stmt.Schema.PrimaryFieldDBNames, values)
+			exprs = append(exprs, clause.IN{Column: column, Values: values})
+		}
+	}
+	if len(exprs) == 0 {
+		// gorm refuses it unless global, which may change the whole table
+		return nil, nil
+	}
+
+	ctx := WithPrimary(WithCacheTTL(stmt.Context, 0))
+	tx := db.Session(&gorm.Session{NewDB: true, SkipHooks: true, Context: ctx})
+	tx.Statement.ConnPool = stmt.ConnPool
+	if stmt.Unscoped {
+		tx = tx.Unscoped()
+	}
+	rows := reflect.New(reflect.SliceOf(stmt.Schema.ModelType))
+	err := tx.Table(stmt.Table).Clauses(clause.Where{Exprs: exprs}).Limit(auditMaxRows + 1).Find(rows.Interface()).Error
+	if err != nil || rows.Elem().Len() > auditMaxRows {
+		return nil, err
+	}
+	return auditRows(stmt.Context, stmt.Schema, rows), nil
+}
+
+// auditValues returns the column values of the model of the statement, one map per record.
+func auditValues(db *gorm.DB) []map[string]interface{} {
+	if db.Statement.Schema == nil || !db.Statement.ReflectValue.IsValid() {
+		return nil
+	}
+	return auditRows(db.Statement.Context, db.Statement.Schema, db.Statement.ReflectValue)
+}
+
+func auditRows(ctx context.Context, s *schema.Schema, models reflect.Value) []map[string]interface{} {
+	var values []map[string]interface{}
+	auditEach(models, func(rv reflect.Value) {
+		row := make(map[string]interface{}, len(s.DBNames))
+		for _, field := range s.Fields {
+			if field.DBName == "" {
+				continue
+			}
+			value, _ := field.ValueOf(ctx, rv)
+			row[field.DBName] = value
+		}
+		values = append(values, row)
+	})
+	return values
+}
+
+func auditEach(rv reflect.Value, fn func(rv reflect.Value)) {
+	rv = reflect.Indirect(rv)
+	switch rv.Kind() {
+	case reflect.Struct:
+		fn(rv)
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			if elem := reflect.Indirect(rv.Index(i)); elem.Kind() == reflect.Struct {
+				fn(elem)
+			}
+		}
+	}
+}
+
+// auditPrimaryKey joins the primary key values of row, it is empty when any of them is zero.
+func auditPrimaryKey(s *schema.Schema, row map[string]interface{}) string {
+	if s == nil || len(s.PrimaryFields) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(s.PrimaryFields))
+	for _, field := range s.PrimaryFields {
+		value, ok := row[field.DBName]
+		if !ok || value == nil || reflect.ValueOf(value).IsZero() {
+			return ""
+		}
+		keys = append(keys, fmt.Sprint(value))
+	}
+	return strings.Join(keys, ",")
+}
+
+func auditCreated(db *gorm.DB) []*AuditRecord {
+	var rows []map[string]interface{}
+	switch dest := db.Statement.Dest.(type) {
+	case map[string]interface{}:
+		rows = []map[string]interface{}{dest}
+	case []map[string]interface{}:
+		rows = dest
+	default:
+		rows = auditValues(db)
+	}
+
+	records := make([]*AuditRecord, 0, len(rows))
+	for _, row := range rows {
+		record := &AuditRecord{PrimaryKey: auditPrimaryKey(db.Statement.Schema, row), RowsAffected: 1}
+		for _, column := range auditColumns(db.Statement.Schema, row) {
+			record.Changes = append(record.Changes, AuditChange{Column: column, New: row[column]})
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func auditUpdated(db *gorm.DB, set clause.Set, olds []map[string]interface{}) []*AuditRecord {
+	news := auditAssignments(set)
+	columns := auditColumns(db.Statement.Schema, news)
+	if len(olds) == 0 {
+		record := &AuditRecord{RowsAffected: db.RowsAffected}
+		if models := auditValues(db); len(models) == 1 {
+			record.PrimaryKey = auditPrimaryKey(db.Statement.Schema, models[0])
+		}
+		for _, column := range columns {
+			record.Changes = append(record.Changes, AuditChange{Column: column, New: news[column]})
+		}
+		return []*AuditRecord{record}
+	}
+
+	records := make([]*AuditRecord, 0, len(olds))
+	for _, old := range olds {
+		record := &AuditRecord{PrimaryKey: auditPrimaryKey(db.Statement.Schema, old), RowsAffected: 1}
+		for _, column := range columns {
+			record.Changes = append(record.Changes, AuditChange{Column: column, Old: old[column], New: news[column]})
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// auditAssignments returns the values of the SET clause of an update by column, zero values included.
+func auditAssignments(set clause.Set) map[string]interface{} {
+	news := make(map[string]interface{}, len(set))
+	for _, assignment := range set {
+		news[assignment.Column.Name] = assignment.Value
+	}
+	return news
+}
+
+func auditDeleted(db *gorm.DB, olds []map[string]interface{}) []*AuditRecord {
+	var records []*AuditRecord
+	for _, old := range olds {
+		pk := auditPrimaryKey(db.Statement.Schema, old)
+		if pk == "" {
+			continue
+		}
+		record := &AuditRecord{PrimaryKey: pk, RowsAffected: 1}
+		for _, column := range auditColumns(db.Statement.Schema, old) {
+			record.Changes = append(record.Changes, AuditChange{Column: column, Old: old[column]})
+		}
+		records = append(records, record)
+	}
+	if len(records) == 0 {
+		records = append(records, &AuditRecord{RowsAffected: db.RowsAffected})
+	}
+	return records
+}
+
+// auditColumns orders the columns of row like the schema, the ones unknown to the schema come last sorted.
+func auditColumns(s *schema.Schema, row map[string]interface{}) []string {
+	columns := make([]string, 0, len(row))
+	known := make(map[string]bool, len(row))
+	if s != nil {
+		for _, column := range s.DBNames {
+			if _, ok := row[column]; ok {
+				columns = append(columns, column)
+				known[column] = true
+			}
+		}
+	}
+	rest := make([]string, 0)
+	for column := range row {
+		if !known[column] {
+			rest = append(rest, column)
+		}
+	}
+	sort.Strings(rest)
+	return append(columns, rest...)
+}
@@ -0,0 +1,131 @@
+package gormbox
+
+import (
+	"context"
+	"errors"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	gormysql "gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"testing"
+)
+
+type auditUser struct {
+	ID   int64
+	Name string
+	Age  int
+}
+
+func mockDB(t *testing.T) (*gorm.DB, sqlmock.Sqlmock) {
+	conn, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	db, err := gorm.Open(gormysql.New(gormysql.Config{Conn: conn, SkipInitializeWithVersion: true}),
+		&gorm.Config{DisableAutomaticPing: true, SkipDefaultTransaction: true})
+	require.NoError(t, err)
+	return db, mock
+}
+
+func TestInterceptorAudit(t *testing.T) {
+	db, mock := mockDB(t)
+	records := make(chan *AuditRecord, 10)
+	Intercept(db, InterceptorAudit(&DSN{}, zap.NewNop(), NewAuditChanSink(records), "audit_users"))
+	ctx := WithActor(WithOperation(context.Background(), "user.save"), "alice")
+
+	mock.ExpectExec("INSERT INTO `audit_users`").WillReturnResult(sqlmock.NewResult(7, 1))
+	user := auditUser{Name: "bob", Age: 20}
+	require.NoError(t, db.WithContext(ctx).Create(&user).Error)
+
+	record := <-records
+	require.Equal(t, "audit_users", record.Table)
+	require.Equal(t, "create", record.Action)
+	require.Equal(t, "7", record.PrimaryKey)
+	require.Equal(t, "alice", record.Actor)
+	require.Equal(t, "user.save", record.Operation)
+	require.Equal(t, []AuditChange{{Column: "id", New: int64(7)}, {Column: "name", New: "bob"}, {Column: "age", New: 20}}, record.Changes)
+
+	// the old values come from the db, not from the model
+	mock.ExpectQuery("SELECT \\* FROM `audit_users` WHERE `audit_users`.`id` = \\? LIMIT \\?").WithArgs(int64(7), auditMaxRows+1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "age"}).AddRow(7, "bob", 19))
+	mock.ExpectExec("UPDATE `audit_users` SET `age`=\\? WHERE `id` = \\?").WillReturnResult(sqlmock.NewResult(0, 1))
+	require.NoError(t, db.WithContext(ctx).Model(&user).Update("age", 21).Error)
+
+	record = <-records
+	require.Equal(t, "update", record.Action)
+	require.Equal(t, "7", record.PrimaryKey)
+	require.Equal(t, []AuditChange{{Column: "age", Old: 19, New: 21}}, record.Changes)
+
+	mock.ExpectQuery("SELECT \\* FROM `audit_users` WHERE `audit_users`.`id` = \\? LIMIT \\?").WithArgs(int64(7), auditMaxRows+1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "age"}).AddRow(7, "bob", 21))
+	mock.ExpectExec("UPDATE `audit_users` SET `name`=\\?,`age`=\\? WHERE `id` = \\?").WillReturnResult(sqlmock.NewResult(0, 1))
+	user.Name, user.Age = "rob", 22
+	require.NoError(t, db.WithContext(ctx).Save(&user).Error)
+
+	record = <-records
+	require.Equal(t, []AuditChange{{Column: "name", Old: "bob", New: "rob"}, {Column: "age", Old: 21, New: 22}}, record.Changes)
+
+	mock.ExpectQuery("SELECT \\* FROM `audit_users` WHERE age < \\? LIMIT \\?").WithArgs(18, auditMaxRows+1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "age"}).AddRow(8, "c", 10).AddRow(9, "d", 12))
+	mock.ExpectExec("DELETE FROM `audit_users` WHERE age < \\?").WillReturnResult(sqlmock.NewResult(0, 2))
+	require.NoError(t, db.WithContext(ctx).Where("age < ?", 18).Delete(&auditUser{}).Error)
+
+	for _, pk := range []string{"8", "9"} {
+		record = <-records
+		require.Equal(t, "delete", record.Action)
+		require.Equal(t, pk, record.PrimaryKey)
+		require.Equal(t, int64(1), record.RowsAffected)
+	}
+	require.Equal(t, []AuditChange{{Column: "id", Old: int64(9)}, {Column: "name", Old: "d"}, {Column: "age", Old: 12}}, record.Changes)
+
+	require.NoError(t, mock.ExpectationsWereMet())
+	require.Empty(t, records)
+}
+
+func TestInterceptorAudit_Transaction(t *testing.T) {
+	// a single connection, held by the implicit transaction of the update
+	db := sqliteDB(t)
+	require.NoError(t, db.AutoMigrate(&auditUser{}))
+	records := make(chan *AuditRecord, 10)
+	withTxHooks(db)
+	Intercept(db, InterceptorAudit(&DSN{}, zap.NewNop(), NewAuditChanSink(records), "audit_users"))
+
+	user := auditUser{Name: "bob", Age: 20}
+	require.NoError(t, db.Create(&user).Error)
+	<-records
+
+	user.Age = 21
+	require.NoError(t, db.Save(&user).Error)
+	record := <-records
+	require.Equal(t, []AuditChange{{Column: "name", Old: "bob", New: "bob"}, {Column: "age", Old: 20, New: 21}}, record.Changes)
+
+	require.NoError(t, db.Model(&auditUser{}).Where("age > ?", 18).Updates(map[string]interface{}{"age": 30}).Error)
+	record = <-records
+	require.Equal(t, "1", record.PrimaryKey)
+	require.Equal(t, []AuditChange{{Column: "age", Old: 21, New: 30}}, record.Changes)
+
+	// Save writes the zero values too
+	user.Name, user.Age = "", 0
+	require.NoError(t, db.Save(&user).Error)
+	record = <-records
+	require.Equal(t, []AuditChange{{Column: "name", Old: "bob", New: ""}, {Column: "age", Old: 30, New: 0}}, record.Changes)
+
+	// audited once committed
+	require.NoError(t, db.Transaction(func(tx *gorm.DB) error {
+		require.NoError(t, tx.Model(&user).Update("age", 40).Error)
+		require.Empty(t, records)
+		return nil
+	}))
+	record = <-records
+	require.Equal(t, []AuditChange{{Column: "age", Old: 0, New: 40}}, record.Changes)
+
+	// and not at all when rolled back
+	err := db.Transaction(func(tx *gorm.DB) error {
+		require.NoError(t, tx.Model(&user).Update("age", 50).Error)
+		require.NoError(t, tx.Create(&auditUser{Name: "carl"}).Error)
+		return errors.New("rollback")
+	})
+	require.EqualError(t, err, "rollback")
+	require.Empty(t, records)
+}
@@ -0,0 +1,224 @@
+package gormbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"reflect"
+	"sync"
+	"time"
+)
+
+var ErrBatchWriterClosed = errors.New("gormbox: batch writer closed")
+
+type BatchOption func(*batchOptions)
+
+type batchOptions struct {
+	size      int
+	interval  time.Duration
+	capacity  int
+	operation string
+	onError   func(table string, rows int, err error)
+}
+
+// BatchOptionSize flushes a table as soon as size rows are buffered for it.
+func BatchOptionSize(size int) BatchOption {
+	return func(o *batchOptions) { o.size = size }
+}
+
+// BatchOptionInterval flushes all tables every interval.
+func BatchOptionInterval(interval time.Duration) BatchOption {
+	return func(o *batchOptions) { o.interval = interval }
+}
+
+// BatchOptionCapacity bounds the rows buffered across tables, Write blocks once it is reached.
+// It can't be below the batch size, 4 batches by default.
+func BatchOptionCapacity(capacity int) BatchOption {
+	return func(o *batchOptions) { o.capacity = capacity }
+}
+
+// BatchOptionOperation names the flushes, a flush of table t runs as operation "<operation>.<t>".
+func BatchOptionOperation(operation string) BatchOption {
+	return func(o *batchOptions) { o.operation = operation }
+}
+
+// BatchOptionOnError is called with the rows dropped by a failed background flush.
+func BatchOptionOnError(fn func(table string, rows int, err error)) BatchOption {
+	return func(o *batchOptions) { o.onError = fn }
+}
+
+// BatchWriter buffers rows by table and inserts them in batches, which is what clickhouse wants.
+// Flushes go through the gorm:create callback, so they are traced, logged and counted like any operation.
+type BatchWriter struct {
+	db      *gorm.DB
+	options *batchOptions
+
+	mu      sync.Mutex
+	buffers map[string][]interface{}
+	closed  bool
+
+	flushMu sync.Mutex
+	slots   chan struct{}
+	full    chan string
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func NewBatchWriter(db *gorm.DB, opts ...BatchOption) (*BatchWriter, error) {
+	options := &batchOptions{size: 1000, interval: time.Second, operation: "batch_insert"}
+	for _, opt := range opts {
+		opt(options)
+	}
+	if options.size <= 0 {
+		return nil, errors.New("gormbox: batch size must be positive")
+	}
+	if options.interval <= 0 {
+		return nil, errors.New("gormbox: batch interval must be positive")
+	}
+	if options.capacity == 0 {
+		options.capacity = options.size * 4
+	}
+	if options.capacity < options.size {
+		// a table would never fill up a batch
+		return nil, fmt.Errorf("gormbox: batch capacity %d below the batch size %d", options.capacity, options.size)
+	}
+
+	w := &BatchWriter{
+		db:      db,
+		options: options,
+		buffers: make(map[string][]interface{}),
+		slots:   make(chan struct{}, options.capacity),
+		full:    make(chan string, 1),
+		done:    make(chan struct{}),
+	}
+	w.wg.Add(1)
+	go w.run()
+	return w, nil
+}
+
+// Write buffers row for table, blocking while the writer is at capacity.
+// All rows of a table must share the same type, a model struct or map[string]interface{}.
+func (w *BatchWriter) Write(ctx context.Context, table string, row interface{}) error {
+	select {
+	case w.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-w.done:
+		return ErrBatchWriterClosed
+	}
+
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		<-w.slots
+		return ErrBatchWriterClosed
+	}
+	w.buffers[table] = append(w.buffers[table], row)
+	full := len(w.buffers[table]) >= w.options.size
+	w.mu.Unlock()
+
+	if full {
+		select {
+		case w.full <- table:
+		default:
+		}
+	}
+	return nil
+}
+
+// Flush inserts everything buffered so far.
+func (w *BatchWriter) Flush(ctx context.Context) error {
+	w.mu.Lock()
+	tables := make([]string, 0, len(w.buffers))
+	for table := range w.buffers {
+		tables = append(tables, table)
+	}
+	w.mu.Unlock()
+
+	var err error
+	for _, table := range tables {
+		if _, flushErr := w.flushRows(ctx, table); flushErr != nil && err == nil {
+			err = flushErr
+		}
+	}
+	return err
+}
+
+// Close stops accepting rows and flushes what is left.
+func (w *BatchWriter) Close(ctx context.Context) error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	close(w.done)
+	w.mu.Unlock()
+
+	w.wg.Wait()
+	return w.Flush(ctx)
+}
+
+func (w *BatchWriter) run() {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(w.options.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case table := <-w.full:
+			w.background(table)
+		case <-ticker.C:
+			w.mu.Lock()
+			tables := make([]string, 0, len(w.buffers))
+			for table := range w.buffers {
+				tables = append(tables, table)
+			}
+			w.mu.Unlock()
+			for _, table := range tables {
+				w.background(table)
+			}
+		}
+	}
+}
+
+func (w *BatchWriter) background(table string) {
+	rows, err := w.flushRows(context.Background(), table)
+	if err != nil && w.options.onError != nil {
+		w.options.onError(table, rows, err)
+	}
+}
+
+func (w *BatchWriter) flushRows(ctx context.Context, table string) (int, error) {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+
+	w.mu.Lock()
+	rows := w.buffers[table]
+	delete(w.buffers, table)
+	w.mu.Unlock()
+
+	if len(rows) == 0 {
+		return 0, nil
+	}
+	defer func() {
+		for range rows {
+			<-w.slots
+		}
+	}()
+
+	typ := reflect.TypeOf(rows[0])
+	values := reflect.MakeSlice(reflect.SliceOf(typ), 0, len(rows))
+	for _, row := range rows {
+		if reflect.TypeOf(row) != typ {
+			return len(rows), fmt.Errorf("gormbox: batch writer table %s mixes %s and %T rows", table, typ, row)
+		}
+		values = reflect.Append(values, reflect.ValueOf(row))
+	}
+	ctx = WithOperation(ctx, w.options.operation+"."+table)
+	return len(rows), w.db.WithContext(ctx).Table(table).Create(values.Interface()).Error
+}
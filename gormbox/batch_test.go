@@ -0,0 +1,79 @@
+package gormbox
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	gormysql "gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"sync"
+	"testing"
+	"time"
+)
+
+type batchEvent struct {
+	ID   int64
+	Name string
+}
+
+// dryRunDB opens a mysql gorm.DB that never reaches the server and records the statements of create.
+func dryRunDB(t *testing.T) (*gorm.DB, func() []string) {
+	db, err := gorm.Open(gormysql.New(gormysql.Config{
+		DSN:                       "root:root@tcp(127.0.0.1:3306)/test",
+		SkipInitializeWithVersion: true,
+	}), &gorm.Config{DryRun: true, DisableAutomaticPing: true, SkipDefaultTransaction: true})
+	require.NoError(t, err)
+
+	var (
+		mu         sync.Mutex
+		statements []string
+	)
+	err = db.Callback().Create().After("gorm:create").Register("test:record", func(db *gorm.DB) {
+		mu.Lock()
+		defer mu.Unlock()
+		statements = append(statements, db.Statement.SQL.String())
+	})
+	require.NoError(t, err)
+	return db, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), statements...)
+	}
+}
+
+func TestBatchWriter(t *testing.T) {
+	db, statements := dryRunDB(t)
+	ctx := context.Background()
+
+	w, err := NewBatchWriter(db, BatchOptionSize(2), BatchOptionInterval(time.Hour))
+	require.NoError(t, err)
+	require.NoError(t, w.Write(ctx, "events", batchEvent{ID: 1, Name: "a"}))
+	require.NoError(t, w.Write(ctx, "events", batchEvent{ID: 2, Name: "b"}))
+	require.Eventually(t, func() bool { return len(statements()) == 1 }, time.Second, 10*time.Millisecond)
+	require.Equal(t, "INSERT INTO `events` (`name`,`id`) VALUES (?,?),(?,?)", statements()[0])
+
+	require.NoError(t, w.Write(ctx, "events", batchEvent{ID: 3, Name: "c"}))
+	require.NoError(t, w.Close(ctx))
+	require.Len(t, statements(), 2)
+	require.ErrorIs(t, w.Write(ctx, "events", batchEvent{ID: 4}), ErrBatchWriterClosed)
+}
+
+func TestBatchWriterBackpressure(t *testing.T) {
+	db, _ := dryRunDB(t)
+
+	_, err := NewBatchWriter(db, BatchOptionSize(10), BatchOptionCapacity(5))
+	require.EqualError(t, err, "gormbox: batch capacity 5 below the batch size 10")
+	_, err = NewBatchWriter(db, BatchOptionInterval(0))
+	require.EqualError(t, err, "gormbox: batch interval must be positive")
+
+	w, err := NewBatchWriter(db, BatchOptionSize(10), BatchOptionCapacity(10), BatchOptionInterval(time.Hour))
+	require.NoError(t, err)
+	defer w.Close(context.Background())
+	for i := 0; i < 9; i++ {
+		require.NoError(t, w.Write(context.Background(), "events", batchEvent{ID: int64(i)}))
+	}
+	require.NoError(t, w.Write(context.Background(), "other", batchEvent{ID: 9}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, w.Write(ctx, "events", batchEvent{ID: 10}), context.DeadlineExceeded)
+}
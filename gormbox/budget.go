@@ -0,0 +1,218 @@
+package gormbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"sync"
+	"time"
+)
+
+var ErrBudgetExceeded = errors.New("gormbox: query budget exceeded")
+
+type BudgetPolicy int
+
+const (
+	// BudgetWarn logs the first breach and lets the statements run.
+	BudgetWarn BudgetPolicy = iota
+	// BudgetFail logs the first breach and fails the statements past the budget with ErrBudgetExceeded.
+	BudgetFail
+)
+
+func (p BudgetPolicy) String() string {
+	if p == BudgetFail {
+		return "fail"
+	}
+	return "warn"
+}
+
+// Budget bounds the statements of a unit of work, e.g. a request, zero values are unbounded.
+type Budget struct {
+	MaxQueries  int
+	MaxDuration time.Duration // total time spent in the db
+	Policy      BudgetPolicy
+}
+
+// BudgetUsage is what the statements issued within a budget spent.
+type BudgetUsage struct {
+	Queries  int
+	Duration time.Duration
+	Exceeded bool
+}
+
+type budgetKey struct{}
+
+type budgetTracker struct {
+	budget Budget
+	parent *budgetTracker
+	span   trace.Span
+
+	mu     sync.Mutex
+	usage  BudgetUsage
+	logger *zap.Logger
+}
+
+// WithBudget counts the statements issued with ctx against budget, see OptionQueryBudget. Budgets nest,
+// the statements count against every enclosing budget. Call end once the unit of work is done: it reports
+// the usage as a log line and as attributes of the span of ctx, and returns it.
+//
+//	ctx, end := gormbox.WithBudget(ctx, gormbox.Budget{MaxQueries: 20, Policy: gormbox.BudgetFail})
+//	defer end()
+func WithBudget(ctx context.Context, budget Budget) (context.Context, func() BudgetUsage) {
+	tracker := &budgetTracker{budget: budget, parent: budgetFrom(ctx), span: trace.SpanFromContext(ctx)}
+	var (
+		once  sync.Once
+		usage BudgetUsage
+	)
+	return context.WithValue(ctx, budgetKey{}, tracker), func() BudgetUsage {
+		once.Do(func() { usage = tracker.end(ctx) })
+		return usage
+	}
+}
+
+// BudgetUsageFrom returns the usage so far of the budget of ctx, false when ctx has none.
+func BudgetUsageFrom(ctx context.Context) (BudgetUsage, bool) {
+	tracker := budgetFrom(ctx)
+	if tracker == nil {
+		return BudgetUsage{}, false
+	}
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	return tracker.usage, true
+}
+
+func budgetFrom(ctx context.Context) *budgetTracker {
+	tracker, _ := ctx.Value(budgetKey{}).(*budgetTracker)
+	return tracker
+}
+
+// exceeded tells whether one more statement breaks the budget.
+func (tracker *budgetTracker) exceeded() bool {
+	return (tracker.budget.MaxQueries > 0 && tracker.usage.Queries >= tracker.budget.MaxQueries) ||
+		(tracker.budget.MaxDuration > 0 && tracker.usage.Duration >= tracker.budget.MaxDuration)
+}
+
+// admit counts one more statement, it returns whether the budget is breached for the first time,
+// whether the statement must be refused and the usage before the statement.
+func (tracker *budgetTracker) admit(logger *zap.Logger) (breached, refuse bool, usage BudgetUsage) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	if tracker.logger == nil {
+		tracker.logger = logger
+	}
+	if tracker.exceeded() {
+		breached, tracker.usage.Exceeded = !tracker.usage.Exceeded, true
+		if tracker.budget.Policy == BudgetFail {
+			return breached, true, tracker.usage
+		}
+	}
+	usage = tracker.usage
+	tracker.usage.Queries++
+	return breached, false, usage
+}
+
+func (tracker *budgetTracker) unadmit() {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	tracker.usage.Queries--
+}
+
+func (tracker *budgetTracker) spend(duration time.Duration) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	tracker.usage.Duration += duration
+}
+
+func (tracker *budgetTracker) end(ctx context.Context) BudgetUsage {
+	tracker.mu.Lock()
+	usage, logger := tracker.usage, tracker.logger
+	tracker.mu.Unlock()
+	if logger == nil {
+		logger = globalLogger
+	}
+
+	tracker.span.SetAttributes(
+		attribute.Int("db.queries", usage.Queries),
+		attribute.Int64("db.duration_ms", usage.Duration.Milliseconds()),
+		attribute.Bool("db.budget_exceeded", usage.Exceeded),
+	)
+	fields := []zap.Field{
+		zap.String("trace_id", trace.SpanContextFromContext(ctx).TraceID().String()),
+		zap.String("span_id", trace.SpanContextFromContext(ctx).SpanID().String()),
+		zap.Int("db.queries", usage.Queries),
+		zap.Duration("db.duration", usage.Duration),
+		zap.Bool("db.budget_exceeded", usage.Exceeded),
+	}
+	if usage.Exceeded {
+		logger.Warn("gormbox budget", fields...)
+	} else {
+		logger.Info("gormbox budget", fields...)
+	}
+	return usage
+}
+
+// InterceptorBudget counts the statements issued with a context carrying WithBudget, and the time they
+// spend, against the budgets of the context.
+func InterceptorBudget(dsn *DSN, logger *zap.Logger) Interceptor {
+	return func(action string, next Handler) Handler {
+		return func(db *gorm.DB) {
+			var (
+				ctx     context.Context
+				tracker *budgetTracker
+			)
+			if ctx = db.Statement.Context; ctx == nil {
+				next(db)
+				return
+			}
+			if tracker = budgetFrom(ctx); tracker == nil {
+				next(db)
+				return
+			}
+
+			var admitted []*budgetTracker
+			for t := tracker; t != nil; t = t.parent {
+				breached, refuse, usage := t.admit(logger)
+				if breached {
+					budgetExceededTotals.WithLabelValues(dsn.Name, OperationFrom(ctx), t.budget.Policy.String()).Inc()
+					t.warn(ctx, dsn, logger, usage)
+				}
+				if refuse {
+					// the budgets already counted this statement, which won't run
+					for _, a := range admitted {
+						a.unadmit()
+					}
+					_ = db.AddError(fmt.Errorf("%w: %d queries, %s in the db", ErrBudgetExceeded, usage.Queries, usage.Duration))
+					return
+				}
+				admitted = append(admitted, t)
+			}
+
+			st := time.Now()
+			next(db)
+			duration := time.Since(st)
+			for _, t := range admitted {
+				t.spend(duration)
+			}
+		}
+	}
+}
+
+func (tracker *budgetTracker) warn(ctx context.Context, dsn *DSN, logger *zap.Logger, usage BudgetUsage) {
+	logger.Warn("gormbox budget exceeded",
+		zap.String("trace_id", trace.SpanContextFromContext(ctx).TraceID().String()),
+		zap.String("span_id", trace.SpanContextFromContext(ctx).SpanID().String()),
+		zap.String("db.system", dsn.Driver),
+		zap.String("db.name", dsn.DbName),
+		zap.String("db.operation", OperationFrom(ctx)),
+		zap.String("policy", tracker.budget.Policy.String()),
+		zap.Int("max_queries", tracker.budget.MaxQueries),
+		zap.Duration("max_duration", tracker.budget.MaxDuration),
+		zap.Int("db.queries", usage.Queries),
+		zap.Duration("db.duration", usage.Duration),
+	)
+}
@@ -0,0 +1,56 @@
+package gormbox
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"gorm.io/gorm"
+	"testing"
+)
+
+func TestInterceptorBudget(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	var executed int
+	handler := InterceptorBudget(&DSN{Driver: DriverMysql}, zap.New(core))("gorm:query", func(db *gorm.DB) { executed++ })
+	run := func(ctx context.Context) error {
+		db := &gorm.DB{Config: &gorm.Config{}, Statement: &gorm.Statement{Context: ctx}}
+		db.Statement.DB = db
+		handler(db)
+		return db.Error
+	}
+
+	ctx, end := WithBudget(WithOperation(context.Background(), "user.list"), Budget{MaxQueries: 2})
+	for i := 0; i < 3; i++ {
+		require.NoError(t, run(ctx))
+	}
+	usage, ok := BudgetUsageFrom(ctx)
+	require.True(t, ok)
+	require.Equal(t, BudgetUsage{Queries: 3, Duration: usage.Duration, Exceeded: true}, usage)
+	require.Equal(t, usage, end())
+	require.Equal(t, 3, executed)
+
+	entries := logs.TakeAll()
+	require.Len(t, entries, 2)
+	require.Equal(t, "gormbox budget exceeded", entries[0].Message)
+	require.Equal(t, "user.list", entries[0].ContextMap()["db.operation"])
+	require.Equal(t, int64(2), entries[0].ContextMap()["db.queries"])
+	require.Equal(t, "gormbox budget", entries[1].Message)
+	require.Equal(t, zapcore.WarnLevel, entries[1].Level)
+	require.Equal(t, int64(3), entries[1].ContextMap()["db.queries"])
+
+	// the inner budget doesn't count the statement its outer budget refuses
+	outer, endOuter := WithBudget(context.Background(), Budget{MaxQueries: 1, Policy: BudgetFail})
+	inner, endInner := WithBudget(outer, Budget{})
+	require.NoError(t, run(inner))
+	err := run(inner)
+	require.ErrorIs(t, err, ErrBudgetExceeded)
+	require.Contains(t, err.Error(), "gormbox: query budget exceeded: 1 queries")
+	require.Equal(t, 1, endInner().Queries)
+	require.Equal(t, BudgetUsage{Queries: 1, Duration: endOuter().Duration, Exceeded: true}, endOuter())
+	require.Equal(t, 4, executed)
+
+	_, ok = BudgetUsageFrom(context.Background())
+	require.False(t, ok)
+}
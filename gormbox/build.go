@@ -1,12 +1,42 @@
 package gormbox
 
 import (
+	"database/sql"
+	"google.golang.org/protobuf/types/known/durationpb"
 	"gorm.io/gorm"
+	"net"
+	"strconv"
+	"time"
+)
+
+type ConfigError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ConfigError) Error() string {
+	return "gormbox: invalid config " + e.Field + ": " + e.Reason
+}
+
+var (
+	defaultPorts = map[string]int32{
+		DriverMysql:      3306,
+		DriverClickhouse: 9000,
+	}
+	// the params hand written mysql dsn keep missing
+	defaultParams = map[string]map[string]string{
+		DriverMysql: {"charset": "utf8mb4", "parseTime": "True", "loc": "Local"},
+	}
 )
 
 //go:generate protoc  --proto_path=. --go_out=paths=source_relative:.  --go-grpc_out=paths=source_relative:. config.proto
 
 func (x *Config) Build(opts ...Option) (*gorm.DB, error) {
+	db, _, err := x.build(opts...)
+	return db, err
+}
+
+func (x *Config) build(opts ...Option) (*gorm.DB, *DSN, error) {
 	options := &options{logger: globalLogger}
 	for _, opt := range opts {
 		opt(options)
@@ -15,34 +45,157 @@ func (x *Config) Build(opts ...Option) (*gorm.DB, error) {
 	if x.Driver == "" {
 		x.Driver = DriverMysql
 	}
+	rawDSN, err := x.FormatDSN()
+	if err != nil {
+		return nil, nil, err
+	}
 	parser := GetParser(x.Driver)
 
-	dsn, err := parser.ParseDSN(x.Dsn)
+	dsn, err := parser.ParseDSN(rawDSN)
+	if err != nil {
+		return nil, nil, err
+	}
+	dsn.Name = options.name
+	dialector := parser.GetDialector(rawDSN)
+	if options.secretProvider != nil {
+		connector, err := newSecretConnector(x.Driver, rawDSN, options.secretProvider)
+		if err != nil {
+			return nil, nil, err
+		}
+		dialector, dsn.Password = dialectorWithConn(x.Driver, sql.OpenDB(connector)), ""
+	}
+	db, err := gorm.Open(dialector, &gorm.Config{})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	db, err := gorm.Open(parser.GetDialector(x.Dsn), &gorm.Config{})
+	sqlDB, err := db.DB()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	x.applyPool(sqlDB, options)
 
-	ints := make([]Interceptor, 0)
+	ints := []Interceptor{InterceptorOptimisticLock(dsn)}
+	if options.explainThreshold > 0 {
+		ints = append(ints, InterceptorExplain(dsn, options.logger, options.explainThreshold, options.explainInterval))
+	}
+	if options.nPlusOneThreshold > 0 {
+		ints = append(ints, InterceptorNPlusOne(dsn, options.logger, options.nPlusOneThreshold))
+	}
+	if options.budget {
+		// inside the cache, hits don't cost any query
+		ints = append(ints, InterceptorBudget(dsn, options.logger))
+	}
+	if options.cache != nil || options.auditSink != nil {
+		// the writes of a transaction invalidate the cache and are audited once it commits
+		withTxHooks(db)
+	}
+	if options.cache != nil {
+		ints = append(ints, InterceptorCache(dsn, options.logger, options.cache))
+	}
+	if options.maxFingerprints > 0 {
+		ints = append(ints, InterceptorFingerprint(dsn, options.maxFingerprints))
+	}
+	if len(options.shardings) > 0 {
+		ints = append(ints, InterceptorSharding(dsn, options.shardings...))
+	}
+	if options.replicas != nil {
+		ints = append(ints, InterceptorReplica(dsn, options.replicas))
+	}
+	if options.tenantColumn != "" {
+		ints = append(ints, InterceptorTenant(options.tenantColumn))
+	}
+	if options.auditSink != nil {
+		ints = append(ints, InterceptorAudit(dsn, options.logger, options.auditSink, options.auditTables...))
+	}
+	if options.recorder {
+		ints = append(ints, InterceptorRecorder())
+	}
 	ints = append(ints, InterceptorTracing(dsn), InterceptorLogging(dsn, options.logger), InterceptorMetrics(dsn))
 
-	replace := func(processor Processor, callbackName string, interceptors ...Interceptor) {
+	Intercept(db, ints...)
+
+	return db, dsn, nil
+}
+
+// applyPool sets the pool settings, zero values fall back to the database/sql defaults.
+func (x *Config) applyPool(sqlDB *sql.DB, options *options) {
+	maxIdleConns := int(x.MaxIdleConns)
+	if maxIdleConns == 0 {
+		maxIdleConns = 2
+	}
+	connMaxLifetime := x.ConnMaxLifetime.AsDuration()
+	if options.secretRefresh > 0 && (connMaxLifetime == 0 || connMaxLifetime > options.secretRefresh) {
+		// recycled connections pick up the refreshed password
+		connMaxLifetime = options.secretRefresh
+	}
+	sqlDB.SetMaxOpenConns(int(x.MaxOpenConns))
+	sqlDB.SetMaxIdleConns(maxIdleConns)
+	sqlDB.SetConnMaxLifetime(connMaxLifetime)
+	sqlDB.SetConnMaxIdleTime(x.ConnMaxIdleTime.AsDuration())
+}
+
+// FormatDSN returns dsn as is, or formats one from the structured fields when dsn is empty.
+func (x *Config) FormatDSN() (string, error) {
+	driver := x.Driver
+	if driver == "" {
+		driver = DriverMysql
+	}
+	parser := GetParser(driver)
+	if parser == nil {
+		return "", &ConfigError{Field: "driver", Reason: "unsupported driver " + strconv.Quote(driver)}
+	}
+	if x.Dsn != "" {
+		return x.Dsn, nil
+	}
+
+	if x.Host == "" {
+		return "", &ConfigError{Field: "host", Reason: "required when dsn is empty"}
+	}
+	if x.Port < 0 || x.Port > 65535 {
+		return "", &ConfigError{Field: "port", Reason: "out of range " + strconv.Itoa(int(x.Port))}
+	}
+	port := x.Port
+	if port == 0 {
+		port = defaultPorts[driver]
+	}
+
+	params := make(map[string]string)
+	for k, v := range defaultParams[driver] {
+		params[k] = v
+	}
+	for k, v := range x.Params {
+		params[k] = v
+	}
+	dsn := &DSN{
+		Driver:   driver,
+		Net:      "tcp",
+		Addr:     net.JoinHostPort(x.Host, strconv.Itoa(int(port))),
+		Username: x.User,
+		Password: x.Password,
+		DbName:   x.Database,
+		TLS:      x.Tls.GetEnable(),
+		TLSSkip:  x.Tls.GetSkipVerify(),
+		Params:   params,
+	}
+	return parser.FormatDSN(dsn)
+}
+
+// Intercept wraps the create, update, delete, query, row and raw callbacks of db with interceptors,
+// the first interceptor is the innermost one.
+func Intercept(db *gorm.DB, interceptors ...Interceptor) {
+	replace := func(processor Processor, callbackName string) {
 		handler := processor.Get(callbackName)
-		for _, interceptor := range ints {
+		for _, interceptor := range interceptors {
 			handler = interceptor(callbackName, handler)
 		}
 		_ = processor.Replace(callbackName, handler)
 	}
-	replace(db.Callback().Create(), "gorm:create", ints...)
-	replace(db.Callback().Update(), "gorm:update", ints...)
-	replace(db.Callback().Delete(), "gorm:delete", ints...)
-	replace(db.Callback().Query(), "gorm:query", ints...)
-	replace(db.Callback().Raw(), "gorm:raw", ints...)
-
-	return db, nil
+	replace(db.Callback().Create(), "gorm:create")
+	replace(db.Callback().Update(), "gorm:update")
+	replace(db.Callback().Delete(), "gorm:delete")
+	replace(db.Callback().Query(), "gorm:query")
+	replace(db.Callback().Row(), "gorm:row")
+	replace(db.Callback().Raw(), "gorm:raw")
 }
 
 func (x *Config) BuildMust(opts ...Option) *gorm.DB {
@@ -66,3 +219,37 @@ func (x *Config) WithDSN(dsn string) *Config {
 	x.Dsn = dsn
 	return x
 }
+
+func (x *Config) WithHost(host string, port int) *Config {
+	x.Host, x.Port = host, int32(port)
+	return x
+}
+
+func (x *Config) WithUser(user, password string) *Config {
+	x.User, x.Password = user, password
+	return x
+}
+
+func (x *Config) WithDatabase(database string) *Config {
+	x.Database = database
+	return x
+}
+
+func (x *Config) WithParam(key, value string) *Config {
+	if x.Params == nil {
+		x.Params = make(map[string]string)
+	}
+	x.Params[key] = value
+	return x
+}
+
+// WithTLS connects over tls when enable, skipVerify skips verifying the server certificate.
+func (x *Config) WithTLS(enable, skipVerify bool) *Config {
+	x.Tls = &Config_TLS{Enable: enable, SkipVerify: skipVerify}
+	return x
+}
+
+func (x *Config) WithPool(maxOpenConns, maxIdleConns int, connMaxLifetime time.Duration) *Config {
+	x.MaxOpenConns, x.MaxIdleConns, x.ConnMaxLifetime = int32(maxOpenConns), int32(maxIdleConns), durationpb.New(connMaxLifetime)
+	return x
+}
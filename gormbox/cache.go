@@ -0,0 +1,284 @@
+package gormbox
+
+import (
+	"context"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/callbacks"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache stores query results, every entry is tagged with the tables it was read from.
+type Cache interface {
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration, tags ...string) error
+	Invalidate(ctx context.Context, tags ...string) error
+}
+
+type cacheTTLKey struct{}
+
+// WithCacheTTL opts the queries issued with ctx into the cache configured by OptionCache.
+func WithCacheTTL(ctx context.Context, ttl time.Duration) context.Context {
+	return context.WithValue(ctx, cacheTTLKey{}, ttl)
+}
+
+func CacheTTLFrom(ctx context.Context) time.Duration {
+	if ttl, ok := ctx.Value(cacheTTLKey{}).(time.Duration); ok {
+		return ttl
+	}
+	return 0
+}
+
+type cacheEntry struct {
+	RowsAffected int64           `json:"rows_affected"`
+	Dest         json.RawMessage `json:"dest"`
+}
+
+// cacheScope identifies the database of dsn, the databases sharing a cache backend share neither entries nor tags.
+func cacheScope(dsn *DSN) string {
+	return dsn.Addr + "/" + dsn.DbName
+}
+
+// cacheTag tags the entries read from table of the database scope.
+func cacheTag(scope, table string) string {
+	return scope + ":" + table
+}
+
+// cacheKey hashes the sql as is, a fingerprint would merge the queries differing by their inlined literals.
+func cacheKey(scope, operation, query string, vars []interface{}) string {
+	hash := sha1.New()
+	hash.Write([]byte(scope))
+	hash.Write([]byte{0})
+	hash.Write([]byte(query))
+	if data, err := json.Marshal(vars); err == nil {
+		hash.Write(data)
+	} else {
+		hash.Write([]byte(fmt.Sprint(vars...)))
+	}
+	return "gormbox:" + operation + ":" + hex.EncodeToString(hash.Sum(nil))
+}
+
+// InterceptorCache serves gorm:query from cache for contexts carrying WithCacheTTL and invalidates
+// the table of every create, update, delete and Exec, whose table is read from its sql. Results round
+// trip through encoding/json, so only the table of the statement is tracked, joined tables are not.
+// Queries inside a transaction skip the cache, the writes of a transaction invalidate once it commits
+// when the db was built with OptionCache, right away otherwise. Keys and tags are scoped to the address
+// and database of dsn, so several databases may share one cache backend.
+func InterceptorCache(dsn *DSN, logger *zap.Logger, cache Cache) Interceptor {
+	scope := cacheScope(dsn)
+	invalidate := func(ctx context.Context, table string) {
+		if err := cache.Invalidate(ctx, cacheTag(scope, table)); err != nil {
+			logger.Error("gormbox cache invalidate error",
+				zap.String("db.table", table),
+				zap.String("exception_msg", err.Error()),
+				zap.String("exception_type", "gorm"),
+			)
+		}
+	}
+	write := func(next Handler) Handler {
+		return func(db *gorm.DB) {
+			next(db)
+
+			table := db.Statement.Table
+			if table == "" {
+				table = cacheRawTable(db.Statement.SQL.String())
+			}
+			if db.Statement.Error != nil || table == "" {
+				return
+			}
+			ctx := db.Statement.Context
+			if !afterCommit(db, func() { invalidate(ctx, table) }) {
+				invalidate(ctx, table)
+			}
+		}
+	}
+
+	query := func(next Handler) Handler {
+		return func(db *gorm.DB) {
+			var (
+				ctx       context.Context
+				operation string
+				ttl       time.Duration
+			)
+			if ctx = db.Statement.Context; ctx == nil || db.Error != nil {
+				next(db)
+				return
+			}
+			// a transaction may read what it didn't commit yet
+			if _, ok := db.Statement.ConnPool.(gorm.TxCommitter); ok {
+				next(db)
+				return
+			}
+			if operation, ttl = OperationFrom(ctx), CacheTTLFrom(ctx); operation == "" || ttl <= 0 {
+				next(db)
+				return
+			}
+
+			// build the statement up front, gorm:query won't build it again
+			callbacks.BuildQuerySQL(db)
+			if db.Error != nil || db.DryRun {
+				next(db)
+				return
+			}
+			key := cacheKey(scope, operation, db.Statement.SQL.String(), db.Statement.Vars)
+
+			if data, ok, err := cache.Get(ctx, key); err == nil && ok {
+				var entry cacheEntry
+				if err = json.Unmarshal(data, &entry); err == nil {
+					if err = json.Unmarshal(entry.Dest, db.Statement.Dest); err == nil {
+						cacheTotals.WithLabelValues(dsn.Name, dsn.Addr, dsn.DbName, operation, "hit").Inc()
+						db.RowsAffected = entry.RowsAffected
+						return
+					}
+				}
+			}
+			cacheTotals.WithLabelValues(dsn.Name, dsn.Addr, dsn.DbName, operation, "miss").Inc()
+
+			next(db)
+
+			if db.Error != nil {
+				return
+			}
+			dest, err := json.Marshal(db.Statement.Dest)
+			if err != nil {
+				return
+			}
+			data, _ := json.Marshal(cacheEntry{RowsAffected: db.RowsAffected, Dest: dest})
+			if err = cache.Set(ctx, key, data, ttl, cacheTag(scope, db.Statement.Table)); err != nil {
+				logger.Error("gormbox cache set error",
+					zap.String("db.operation", operation),
+					zap.String("exception_msg", err.Error()),
+					zap.String("exception_type", "gorm"),
+				)
+			}
+		}
+	}
+
+	return func(action string, next Handler) Handler {
+		switch action {
+		case "gorm:query":
+			return query(next)
+		case "gorm:create", "gorm:update", "gorm:delete", "gorm:raw":
+			return write(next)
+		}
+		return next
+	}
+}
+
+var cacheRawWrite = regexp.MustCompile("(?is)^\\s*(?:" +
+	"(?:insert|replace)(?:\\s+(?:low_priority|delayed|high_priority|ignore))*(?:\\s+into)?" +
+	"|update(?:\\s+(?:low_priority|ignore))*" +
+	"|delete(?:\\s+(?:low_priority|quick|ignore))*\\s+from" +
+	"|truncate(?:\\s+table)?" +
+	")\\s+([\\w.`\"]+)")
+
+// cacheRawTable returns the table written by the raw sql, the first one of a multi table statement,
+// "" for any other statement.
+func cacheRawTable(sql string) string {
+	m := cacheRawWrite.FindStringSubmatch(sql)
+	if m == nil {
+		return ""
+	}
+	table := m[1]
+	if i := strings.LastIndexByte(table, '.'); i >= 0 {
+		table = table[i+1:]
+	}
+	return strings.Trim(table, "`\"")
+}
+
+// txHookPool is the ConnPool of a db whose transactions run hooks once committed, see afterCommit.
+type txHookPool struct {
+	gorm.ConnPool
+}
+
+// withTxHooks makes the transactions of db run the hooks of afterCommit.
+func withTxHooks(db *gorm.DB) {
+	db.ConnPool = &txHookPool{ConnPool: db.ConnPool}
+	db.Statement.ConnPool = db.ConnPool
+}
+
+func (p *txHookPool) BeginTx(ctx context.Context, opts *sql.TxOptions) (gorm.ConnPool, error) {
+	var (
+		tx  gorm.ConnPool
+		err error
+	)
+	switch beginner := p.ConnPool.(type) {
+	case gorm.TxBeginner:
+		var sqlTx *sql.Tx
+		if sqlTx, err = beginner.BeginTx(ctx, opts); err == nil {
+			tx = sqlTx
+		}
+	case gorm.ConnPoolBeginner:
+		tx, err = beginner.BeginTx(ctx, opts)
+	default:
+		err = gorm.ErrInvalidTransaction
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &txHookTx{ConnPool: tx, pool: p}, nil
+}
+
+func (p *txHookPool) GetDBConn() (*sql.DB, error) {
+	switch pool := p.ConnPool.(type) {
+	case *sql.DB:
+		return pool, nil
+	case gorm.GetDBConnector:
+		return pool.GetDBConn()
+	}
+	return nil, gorm.ErrInvalidDB
+}
+
+type txHookTx struct {
+	gorm.ConnPool
+	pool *txHookPool
+
+	mu    sync.Mutex
+	hooks []func()
+}
+
+func (tx *txHookTx) Commit() error {
+	err := tx.ConnPool.(gorm.TxCommitter).Commit()
+	tx.mu.Lock()
+	hooks := tx.hooks
+	tx.hooks = nil
+	tx.mu.Unlock()
+	if err == nil {
+		for _, hook := range hooks {
+			hook()
+		}
+	}
+	return err
+}
+
+func (tx *txHookTx) Rollback() error {
+	tx.mu.Lock()
+	tx.hooks = nil
+	tx.mu.Unlock()
+	return tx.ConnPool.(gorm.TxCommitter).Rollback()
+}
+
+func (tx *txHookTx) GetDBConn() (*sql.DB, error) {
+	return tx.pool.GetDBConn()
+}
+
+// afterCommit runs hook once the transaction of the statement commits, it returns false when the statement
+// runs outside of a transaction, or in one of a db without withTxHooks.
+func afterCommit(db *gorm.DB, hook func()) bool {
+	tx, ok := db.Statement.ConnPool.(*txHookTx)
+	if !ok {
+		return false
+	}
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	tx.hooks = append(tx.hooks, hook)
+	return true
+}
@@ -0,0 +1,78 @@
+package gormbox
+
+import (
+	"context"
+	"errors"
+	"github.com/go-redis/redis/v8"
+	"time"
+)
+
+var _ Cache = (*RedisCache)(nil)
+
+// redisExtendTTL sets the ttl of the tag set KEYS[1] to ARGV[1] ms unless it already outlives it,
+// a tag has to outlive every key tagged with it. Zero is no expiry.
+var redisExtendTTL = redis.NewScript(`
+local ttl = tonumber(ARGV[1])
+if ttl <= 0 then
+	return redis.call("PERSIST", KEYS[1])
+end
+local current = redis.call("PTTL", KEYS[1])
+-- a set without expiry is either new or tags a key without expiry
+if current == -1 and redis.call("SCARD", KEYS[1]) > 1 then
+	return 0
+end
+if current < ttl then
+	return redis.call("PEXPIRE", KEYS[1], ttl)
+end
+return 0
+`)
+
+// RedisCache keeps every tag as a set of the keys tagged with it, the client built by redisbox fits in.
+type RedisCache struct {
+	client redis.Cmdable
+	prefix string
+}
+
+func NewRedisCache(client redis.Cmdable, prefix string) *RedisCache {
+	return &RedisCache{client: client, prefix: prefix}
+}
+
+func (c *RedisCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	value, err := c.client.Get(ctx, c.prefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func (c *RedisCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration, tags ...string) error {
+	_, err := c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, c.prefix+key, value, ttl)
+		for _, tag := range tags {
+			pipe.SAdd(ctx, c.tagKey(tag), c.prefix+key)
+			redisExtendTTL.Eval(ctx, pipe, []string{c.tagKey(tag)}, ttl.Milliseconds())
+		}
+		return nil
+	})
+	return err
+}
+
+func (c *RedisCache) Invalidate(ctx context.Context, tags ...string) error {
+	for _, tag := range tags {
+		keys, err := c.client.SMembers(ctx, c.tagKey(tag)).Result()
+		if err != nil {
+			return err
+		}
+		if err = c.client.Del(ctx, append(keys, c.tagKey(tag))...).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *RedisCache) tagKey(tag string) string {
+	return c.prefix + "tag:" + tag
+}
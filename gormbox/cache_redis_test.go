@@ -0,0 +1,47 @@
+package gormbox
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestRedisCache(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+	cache := NewRedisCache(client, "test:")
+	ctx := context.Background()
+
+	_, ok, err := cache.Get(ctx, "a")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	require.NoError(t, cache.Set(ctx, "a", []byte("1"), time.Hour, "user"))
+	require.NoError(t, cache.Set(ctx, "b", []byte("2"), time.Second, "user", "order"))
+	value, ok, err := cache.Get(ctx, "a")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, []byte("1"), value)
+
+	// the short ttl of b doesn't shorten the tag of a
+	require.Equal(t, time.Hour, server.TTL("test:tag:user"))
+	require.Equal(t, time.Second, server.TTL("test:tag:order"))
+	server.FastForward(2 * time.Second)
+	require.True(t, server.Exists("test:tag:user"))
+	require.False(t, server.Exists("test:b"))
+
+	require.NoError(t, cache.Invalidate(ctx, "user"))
+	_, ok, err = cache.Get(ctx, "a")
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.False(t, server.Exists("test:tag:user"))
+
+	// a key without expiry keeps its tag for good
+	require.NoError(t, cache.Set(ctx, "c", []byte("3"), 0, "user"))
+	require.NoError(t, cache.Set(ctx, "d", []byte("4"), time.Second, "user"))
+	require.Zero(t, server.TTL("test:tag:user"))
+}
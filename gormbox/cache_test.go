@@ -0,0 +1,176 @@
+package gormbox
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLRUCache(t *testing.T) {
+	ctx := context.Background()
+	cache := NewLRUCache(2)
+
+	require.NoError(t, cache.Set(ctx, "a", []byte("1"), time.Minute, "user"))
+	require.NoError(t, cache.Set(ctx, "b", []byte("2"), time.Minute, "order"))
+	require.NoError(t, cache.Set(ctx, "c", []byte("3"), time.Minute, "user"))
+
+	_, ok, _ := cache.Get(ctx, "a")
+	require.False(t, ok, "evicted")
+
+	value, ok, _ := cache.Get(ctx, "b")
+	require.True(t, ok)
+	require.Equal(t, []byte("2"), value)
+
+	require.NoError(t, cache.Invalidate(ctx, "user"))
+	_, ok, _ = cache.Get(ctx, "c")
+	require.False(t, ok, "invalidated")
+	_, ok, _ = cache.Get(ctx, "b")
+	require.True(t, ok)
+
+	require.NoError(t, cache.Set(ctx, "d", []byte("4"), -time.Second))
+	_, ok, _ = cache.Get(ctx, "d")
+	require.False(t, ok, "expired")
+}
+
+func TestCacheKey(t *testing.T) {
+	require.Equal(t,
+		cacheKey("db:3306/shop", "user.get", "SELECT * FROM user WHERE id = ?", []interface{}{1}),
+		cacheKey("db:3306/shop", "user.get", "SELECT * FROM user WHERE id = ?", []interface{}{1}))
+	require.NotEqual(t,
+		cacheKey("db:3306/shop", "user.get", "SELECT * FROM user WHERE id = ?", []interface{}{1}),
+		cacheKey("db:3306/shop", "user.get", "SELECT * FROM user WHERE id = ?", []interface{}{2}))
+	require.NotEqual(t,
+		cacheKey("db:3306/shop", "user.get", "SELECT * FROM user WHERE id = 1", nil),
+		cacheKey("db:3306/shop", "user.get", "SELECT * FROM user WHERE id = 2", nil))
+	require.NotEqual(t,
+		cacheKey("db:3306/shop", "user.get", "SELECT * FROM user WHERE id = ?", []interface{}{1}),
+		cacheKey("db:3306/blog", "user.get", "SELECT * FROM user WHERE id = ?", []interface{}{1}))
+}
+
+func TestCacheRawTable(t *testing.T) {
+	for sql, table := range map[string]string{
+		"INSERT INTO cache_items (name) VALUES ('a')":   "cache_items",
+		"insert ignore into `app`.`cache_items` VALUES": "cache_items",
+		"REPLACE cache_items SET name = 'a'":            "cache_items",
+		" UPDATE LOW_PRIORITY cache_items SET name = ?": "cache_items",
+		"DELETE FROM \"cache_items\" WHERE id = 1":      "cache_items",
+		"TRUNCATE TABLE cache_items":                    "cache_items",
+		"SELECT * FROM cache_items":                     "",
+		"CREATE TABLE cache_items (id int)":             "",
+	} {
+		require.Equal(t, table, cacheRawTable(sql), sql)
+	}
+}
+
+type cacheItem struct {
+	ID   int64
+	Name string
+}
+
+// invalidations records the tags invalidated.
+type invalidations struct {
+	Cache
+	mu   sync.Mutex
+	tags []string
+}
+
+func (c *invalidations) Invalidate(ctx context.Context, tags ...string) error {
+	c.mu.Lock()
+	c.tags = append(c.tags, tags...)
+	c.mu.Unlock()
+	return c.Cache.Invalidate(ctx, tags...)
+}
+
+func (c *invalidations) Tags() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.tags...)
+}
+
+func TestInterceptorCache(t *testing.T) {
+	db := sqliteDB(t)
+	require.NoError(t, db.AutoMigrate(&cacheItem{}))
+	require.NoError(t, db.Create(&[]cacheItem{{ID: 1, Name: "a"}, {ID: 2, Name: "b"}}).Error)
+	cache := &invalidations{Cache: NewLRUCache(16)}
+	withTxHooks(db)
+	Intercept(db, InterceptorCache(&DSN{Driver: "sqlite"}, zap.NewNop(), cache))
+	ctx := WithCacheTTL(WithOperation(context.Background(), "item.get"), time.Minute)
+
+	get := func(tx *gorm.DB, where string) string {
+		var item cacheItem
+		require.NoError(t, tx.Where(where).First(&item).Error)
+		return item.Name
+	}
+	// the literals make different queries
+	require.Equal(t, "a", get(db.WithContext(ctx), "id = 1"))
+	require.Equal(t, "b", get(db.WithContext(ctx), "id = 2"))
+
+	// an Exec invalidates the table it writes
+	require.NoError(t, db.WithContext(ctx).Exec("UPDATE cache_items SET name = ? WHERE id = 1", "c").Error)
+	require.Equal(t, []string{"/:cache_items"}, cache.Tags())
+	require.Equal(t, "c", get(db.WithContext(ctx), "id = 1"))
+
+	// the writes of a transaction invalidate once it commits
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		require.NoError(t, tx.Model(&cacheItem{ID: 1}).Update("name", "d").Error)
+		require.Len(t, cache.Tags(), 1)
+		// the transaction reads past the cache
+		require.Equal(t, "d", get(tx, "id = 1"))
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, cache.Tags(), 2)
+	require.Equal(t, "d", get(db.WithContext(ctx), "id = 1"))
+
+	err = db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		require.NoError(t, tx.Model(&cacheItem{ID: 1}).Update("name", "e").Error)
+		return errors.New("rollback")
+	})
+	require.Error(t, err)
+	require.Len(t, cache.Tags(), 2)
+
+	// the implicit transaction of a write commits too
+	require.NoError(t, db.WithContext(ctx).Create(&cacheItem{ID: 3, Name: "f"}).Error)
+	require.Len(t, cache.Tags(), 3)
+
+	sqlDB, err := db.DB()
+	require.NoError(t, err)
+	require.NoError(t, sqlDB.Ping())
+}
+
+func TestInterceptorCache_SharedBackend(t *testing.T) {
+	cache := NewLRUCache(16)
+	ctx := WithCacheTTL(WithOperation(context.Background(), "item.get"), time.Minute)
+	dbs := make([]*gorm.DB, 2)
+	for i, name := range []string{"a", "b"} {
+		dbs[i] = sqliteDB(t)
+		require.NoError(t, dbs[i].AutoMigrate(&cacheItem{}))
+		require.NoError(t, dbs[i].Create(&cacheItem{ID: 1, Name: name}).Error)
+		Intercept(dbs[i], InterceptorCache(&DSN{Driver: "sqlite", Addr: "localhost", DbName: name}, zap.NewNop(), cache))
+	}
+
+	for i, name := range []string{"a", "b"} {
+		var item cacheItem
+		require.NoError(t, dbs[i].WithContext(ctx).First(&item, 1).Error)
+		require.Equal(t, name, item.Name)
+	}
+
+	// a write on one database leaves the entries of the other
+	require.NoError(t, dbs[0].WithContext(ctx).Model(&cacheItem{ID: 1}).Update("name", "c").Error)
+	// past the interceptor, the entry of b stays cached
+	sqlDB, err := dbs[1].DB()
+	require.NoError(t, err)
+	_, err = sqlDB.Exec("UPDATE cache_items SET name = 'd'")
+	require.NoError(t, err)
+	var item cacheItem
+	require.NoError(t, dbs[0].WithContext(ctx).First(&item, 1).Error)
+	require.Equal(t, "c", item.Name)
+	item = cacheItem{}
+	require.NoError(t, dbs[1].WithContext(ctx).First(&item, 1).Error)
+	require.Equal(t, "b", item.Name)
+}
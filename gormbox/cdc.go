@@ -0,0 +1,593 @@
+package gormbox
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const cdcSaveTimeout = 5 * time.Second
+
+// CDCPosition is a position in the binlog of the source.
+type CDCPosition struct {
+	File string
+	Pos  uint32
+}
+
+func (p CDCPosition) String() string {
+	return p.File + ":" + strconv.FormatUint(uint64(p.Pos), 10)
+}
+
+type CDCAction string
+
+const (
+	CDCInsert CDCAction = "insert"
+	CDCUpdate CDCAction = "update"
+	CDCDelete CDCAction = "delete"
+)
+
+// CDCEvent is the change of a row, its columns by name.
+type CDCEvent struct {
+	Schema   string
+	Table    string
+	Action   CDCAction
+	Before   map[string]interface{} // the row before an update or a delete
+	After    map[string]interface{} // the row after an insert or an update
+	Time     time.Time              // when the statement ran on the source
+	Position CDCPosition            // the end of the event in the binlog
+
+	// db names the columns of the models scanned
+	db *gorm.DB
+}
+
+// ScanBefore sets the fields of dest, a pointer to a model, from the row before the change.
+func (e *CDCEvent) ScanBefore(dest interface{}) error {
+	return cdcScan(e.db, e.Before, dest)
+}
+
+// ScanAfter sets the fields of dest, a pointer to a model, from the row after the change.
+func (e *CDCEvent) ScanAfter(dest interface{}) error {
+	return cdcScan(e.db, e.After, dest)
+}
+
+// cdcSchemas caches the schemas of the models scanned from events without db
+var cdcSchemas sync.Map
+
+// cdcScan names the columns of dest with the naming strategy of db, the default one without db.
+func cdcScan(db *gorm.DB, row map[string]interface{}, dest interface{}) error {
+	rv := reflect.ValueOf(dest)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("gormbox: cdc scan into %T, want a pointer to a model", dest)
+	}
+	var s *schema.Schema
+	if db != nil {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(dest); err != nil {
+			return err
+		}
+		s = stmt.Schema
+	} else {
+		var err error
+		if s, err = schema.Parse(dest, &cdcSchemas, schema.NamingStrategy{}); err != nil {
+			return err
+		}
+	}
+	for column, value := range row {
+		if field := s.LookUpField(column); field != nil {
+			if err := field.Set(context.Background(), rv.Elem(), value); err != nil {
+				return fmt.Errorf("gormbox: cdc scan %s.%s: %w", s.Table, column, err)
+			}
+		}
+	}
+	return nil
+}
+
+type CDCHandler interface {
+	Handle(ctx context.Context, event *CDCEvent) error
+}
+
+type CDCHandlerFunc func(ctx context.Context, event *CDCEvent) error
+
+func (f CDCHandlerFunc) Handle(ctx context.Context, event *CDCEvent) error {
+	return f(ctx, event)
+}
+
+// CDCCheckpoint stores the position the stream resumes from.
+type CDCCheckpoint interface {
+	// Load returns the zero position when nothing was saved.
+	Load(ctx context.Context) (CDCPosition, error)
+	Save(ctx context.Context, position CDCPosition) error
+}
+
+type cdcCheckpointRow struct {
+	Name      string `gorm:"primaryKey;size:191"`
+	File      string `gorm:"size:255;not null"`
+	Pos       uint32 `gorm:"not null"`
+	UpdatedAt time.Time
+}
+
+type cdcTableCheckpoint struct {
+	db    *gorm.DB
+	table string
+	name  string
+
+	once sync.Once
+	err  error
+}
+
+// NewCDCTableCheckpoint stores the position of the stream name as a row of table, created when missing.
+func NewCDCTableCheckpoint(db *gorm.DB, table, name string) CDCCheckpoint {
+	return &cdcTableCheckpoint{db: db, table: table, name: name}
+}
+
+func (c *cdcTableCheckpoint) migrate() error {
+	c.once.Do(func() {
+		c.err = c.db.WithContext(WithoutTenant(context.Background())).Table(c.table).AutoMigrate(&cdcCheckpointRow{})
+	})
+	return c.err
+}
+
+func (c *cdcTableCheckpoint) Load(ctx context.Context) (CDCPosition, error) {
+	if err := c.migrate(); err != nil {
+		return CDCPosition{}, err
+	}
+	var rows []cdcCheckpointRow
+	if err := c.db.WithContext(WithoutTenant(ctx)).Table(c.table).Where("name = ?", c.name).Limit(1).Find(&rows).Error; err != nil || len(rows) == 0 {
+		return CDCPosition{}, err
+	}
+	return CDCPosition{File: rows[0].File, Pos: rows[0].Pos}, nil
+}
+
+func (c *cdcTableCheckpoint) Save(ctx context.Context, position CDCPosition) error {
+	if err := c.migrate(); err != nil {
+		return err
+	}
+	row := &cdcCheckpointRow{Name: c.name, File: position.File, Pos: position.Pos, UpdatedAt: time.Now()}
+	return c.db.WithContext(WithoutTenant(ctx)).Table(c.table).Clauses(clause.OnConflict{UpdateAll: true}).Create(row).Error
+}
+
+type CDCOption func(*cdcOptions)
+
+type cdcOptions struct {
+	name               string
+	logger             *zap.Logger
+	serverID           uint32
+	checkpoint         CDCCheckpoint
+	checkpointInterval time.Duration
+	minBackoff         time.Duration
+	maxBackoff         time.Duration
+}
+
+// CDCOptionName is the logical name of the db in the metric labels and of the default checkpoint.
+func CDCOptionName(name string) CDCOption {
+	return func(o *cdcOptions) { o.name = name }
+}
+
+func CDCOptionLogger(logger *zap.Logger) CDCOption {
+	return func(o *cdcOptions) { o.logger = logger }
+}
+
+// CDCOptionServerID is the server id the stream registers with, unique among the replicas of the source.
+// It is picked at random by default.
+func CDCOptionServerID(id uint32) CDCOption {
+	return func(o *cdcOptions) { o.serverID = id }
+}
+
+// CDCOptionCheckpoint stores the position elsewhere than in the table "gormbox_cdc_checkpoints" of the db.
+func CDCOptionCheckpoint(checkpoint CDCCheckpoint) CDCOption {
+	return func(o *cdcOptions) { o.checkpoint = checkpoint }
+}
+
+// CDCOptionCheckpointInterval is how often the position is saved, 1s by default, zero saves after every transaction.
+func CDCOptionCheckpointInterval(interval time.Duration) CDCOption {
+	return func(o *cdcOptions) { o.checkpointInterval = interval }
+}
+
+// CDCOptionBackoff delays the retry of an event its handler failed by min, doubled after every attempt up to max.
+func CDCOptionBackoff(min, max time.Duration) CDCOption {
+	return func(o *cdcOptions) { o.minBackoff, o.maxBackoff = min, max }
+}
+
+// CDC streams the row changes of mysql tables from the binlog of the source, in ROW format with
+// binlog_row_image=FULL. Column names come with the events when binlog_row_metadata=FULL, they are
+// read from information_schema through db otherwise.
+//
+// Events are delivered at least once: the position is saved at the end of the transactions whose
+// events were all handled, a stream resuming after a crash delivers the events since then again.
+// A failing handler is retried until it succeeds, the events of the stream are handled in order.
+type CDC struct {
+	db       *gorm.DB
+	dsn      *DSN
+	options  *cdcOptions
+	handlers map[string]CDCHandler
+
+	// columns caches the columns of the tables by "schema.table", reset on ddl
+	columns map[string]*cdcColumns
+}
+
+// NewCDC streams the changes of the source dsn, a mysql dsn parsed by GetParser(DriverMysql) with
+// a user granted REPLICATION SLAVE and REPLICATION CLIENT, db connects to the same source.
+func NewCDC(db *gorm.DB, dsn *DSN, opts ...CDCOption) *CDC {
+	options := &cdcOptions{
+		name:               dsn.Name,
+		logger:             globalLogger,
+		serverID:           1<<30 + uint32(time.Now().UnixNano()%(1<<30)),
+		checkpointInterval: time.Second,
+		minBackoff:         100 * time.Millisecond,
+		maxBackoff:         time.Minute,
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+	if options.checkpoint == nil {
+		name := options.name
+		if name == "" {
+			name = "default"
+		}
+		options.checkpoint = NewCDCTableCheckpoint(db, "gormbox_cdc_checkpoints", name)
+	}
+	return &CDC{db: db, dsn: dsn, options: options, handlers: make(map[string]CDCHandler), columns: make(map[string]*cdcColumns)}
+}
+
+// Handle delivers the changes of table, "schema.table" or a table of the db of the dsn, to handler.
+// The changes of the tables without handler are skipped. Handle is not safe to call while running.
+func (c *CDC) Handle(table string, handler CDCHandler) {
+	if !strings.Contains(table, ".") {
+		table = c.dsn.DbName + "." + table
+	}
+	c.handlers[table] = handler
+}
+
+// Run streams from the saved position, or from the current position of the source the first time,
+// until ctx is done or the stream fails.
+func (c *CDC) Run(ctx context.Context) error {
+	if c.dsn.Driver != DriverMysql {
+		return fmt.Errorf("gormbox: cdc on %s, want mysql", c.dsn.Driver)
+	}
+	config, err := c.syncerConfig()
+	if err != nil {
+		return err
+	}
+
+	position, err := c.options.checkpoint.Load(ctx)
+	if err != nil {
+		return err
+	}
+	if position.File == "" {
+		if position, err = c.masterPosition(ctx); err != nil {
+			return err
+		}
+	}
+
+	syncer := replication.NewBinlogSyncer(config)
+	defer syncer.Close()
+	streamer, err := syncer.StartSync(mysql.Position{Name: position.File, Pos: position.Pos})
+	if err != nil {
+		return err
+	}
+	c.options.logger.Info("gormbox cdc start", zap.String("cdc.position", position.String()))
+	return c.consume(ctx, streamer, position)
+}
+
+func (c *CDC) syncerConfig() (replication.BinlogSyncerConfig, error) {
+	if c.dsn.Net == "unix" {
+		return replication.BinlogSyncerConfig{}, errors.New("gormbox: cdc over a unix socket is not supported")
+	}
+	host, port, err := net.SplitHostPort(strings.Split(c.dsn.Addr, ",")[0])
+	if err != nil {
+		return replication.BinlogSyncerConfig{}, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return replication.BinlogSyncerConfig{}, err
+	}
+	config := replication.BinlogSyncerConfig{
+		ServerID:  c.options.serverID,
+		Flavor:    mysql.MySQLFlavor,
+		Host:      host,
+		Port:      uint16(p),
+		User:      c.dsn.Username,
+		Password:  c.dsn.Password,
+		ParseTime: true,
+		// heartbeats let a quiet stream save its position
+		HeartbeatPeriod: 10 * time.Second,
+	}
+	if c.dsn.TLS {
+		config.TLSConfig = &tls.Config{ServerName: host, InsecureSkipVerify: c.dsn.TLSSkip}
+	}
+	return config, nil
+}
+
+func (c *CDC) masterPosition(ctx context.Context) (CDCPosition, error) {
+	rows, err := c.db.WithContext(WithoutTenant(ctx)).Raw("SHOW MASTER STATUS").Rows()
+	if err != nil {
+		return CDCPosition{}, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return CDCPosition{}, err
+	}
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return CDCPosition{}, err
+		}
+		return CDCPosition{}, errors.New("gormbox: cdc source has binary logging off")
+	}
+	var position CDCPosition
+	dest := make([]interface{}, len(columns))
+	for i := range dest {
+		dest[i] = new(sql.RawBytes)
+	}
+	dest[0], dest[1] = &position.File, &position.Pos
+	return position, rows.Scan(dest...)
+}
+
+type cdcStream interface {
+	GetEvent(ctx context.Context) (*replication.BinlogEvent, error)
+}
+
+// consume delivers the events of stream, which starts at position, saving the end of the transactions handled.
+func (c *CDC) consume(ctx context.Context, stream cdcStream, position CDCPosition) error {
+	var (
+		committed = position
+		saved     = position
+		lastSave  = time.Now()
+	)
+	save := func() error {
+		if committed == saved {
+			return nil
+		}
+		// ctx may be done already, the position handled is saved anyway
+		saveCtx, cancel := context.WithTimeout(context.Background(), cdcSaveTimeout)
+		defer cancel()
+		if err := c.options.checkpoint.Save(saveCtx, committed); err != nil {
+			return err
+		}
+		saved, lastSave = committed, time.Now()
+		return nil
+	}
+
+	for {
+		ev, err := stream.GetEvent(ctx)
+		if err == nil {
+			err = c.event(ctx, ev, &position, &committed)
+		}
+		if err != nil {
+			if saveErr := save(); saveErr != nil {
+				c.options.logger.Error("gormbox cdc checkpoint error",
+					zap.String("cdc.position", committed.String()),
+					zap.String("exception_msg", saveErr.Error()),
+					zap.String("exception_type", "gorm"),
+				)
+			}
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if time.Since(lastSave) >= c.options.checkpointInterval {
+			if err = save(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (c *CDC) event(ctx context.Context, ev *replication.BinlogEvent, position, committed *CDCPosition) error {
+	switch e := ev.Event.(type) {
+	case *replication.RotateEvent:
+		*position = CDCPosition{File: string(e.NextLogName), Pos: uint32(e.Position)}
+		return nil
+	case *replication.RowsEvent:
+		if err := c.rows(ctx, ev.Header, e, position.File); err != nil {
+			return err
+		}
+	case *replication.XIDEvent:
+		*committed = CDCPosition{File: position.File, Pos: ev.Header.LogPos}
+	case *replication.QueryEvent:
+		commit, ddl := cdcQuery(string(e.Query))
+		if ddl {
+			// ddl may change the columns
+			c.columns = make(map[string]*cdcColumns)
+		}
+		if commit {
+			*committed = CDCPosition{File: position.File, Pos: ev.Header.LogPos}
+		}
+	}
+	if ev.Header.LogPos > 0 {
+		position.Pos = ev.Header.LogPos
+	}
+	return nil
+}
+
+// cdcQuery tells whether the query of a query event ends a transaction: COMMIT, written for the non transactional
+// tables, and ddl, which commits implicitly. BEGIN, SAVEPOINT, ROLLBACK TO and the statements of a statement based
+// binlog are within a transaction.
+func cdcQuery(query string) (commit, ddl bool) {
+	for query = strings.TrimSpace(query); strings.HasPrefix(query, "/*") && !strings.HasPrefix(query, "/*!"); {
+		end := strings.Index(query, "*/")
+		if end < 0 {
+			return false, false
+		}
+		query = strings.TrimSpace(query[end+2:])
+	}
+	words := strings.Fields(strings.ToUpper(query))
+	if len(words) == 0 {
+		return false, false
+	}
+	switch words[0] {
+	case "COMMIT":
+		return true, false
+	case "XA":
+		return len(words) > 1 && words[1] == "COMMIT", false
+	case "CREATE", "ALTER", "DROP", "RENAME", "TRUNCATE":
+		return true, true
+	}
+	return false, false
+}
+
+func (c *CDC) rows(ctx context.Context, header *replication.EventHeader, e *replication.RowsEvent, file string) error {
+	if e.Table == nil {
+		return nil
+	}
+	schemaName, table := string(e.Table.Schema), string(e.Table.Table)
+	handler, ok := c.handlers[schemaName+"."+table]
+	if !ok {
+		return nil
+	}
+
+	var action CDCAction
+	switch header.EventType {
+	case replication.WRITE_ROWS_EVENTv0, replication.WRITE_ROWS_EVENTv1, replication.WRITE_ROWS_EVENTv2:
+		action = CDCInsert
+	case replication.UPDATE_ROWS_EVENTv0, replication.UPDATE_ROWS_EVENTv1, replication.UPDATE_ROWS_EVENTv2:
+		action = CDCUpdate
+	case replication.DELETE_ROWS_EVENTv0, replication.DELETE_ROWS_EVENTv1, replication.DELETE_ROWS_EVENTv2:
+		action = CDCDelete
+	default:
+		return nil
+	}
+	columns, err := c.tableColumns(ctx, e.Table)
+	if err != nil {
+		return err
+	}
+
+	step := 1
+	if action == CDCUpdate {
+		// the rows of an update alternate before and after images
+		step = 2
+	}
+	for i := 0; i+step <= len(e.Rows); i += step {
+		event := &CDCEvent{
+			Schema:   schemaName,
+			Table:    table,
+			Action:   action,
+			Time:     time.Unix(int64(header.Timestamp), 0),
+			Position: CDCPosition{File: file, Pos: header.LogPos},
+			db:       c.db,
+		}
+		switch action {
+		case CDCInsert:
+			event.After = columns.row(e.Rows[i], e.Table.ColumnType)
+		case CDCUpdate:
+			event.Before, event.After = columns.row(e.Rows[i], e.Table.ColumnType), columns.row(e.Rows[i+1], e.Table.ColumnType)
+		case CDCDelete:
+			event.Before = columns.row(e.Rows[i], e.Table.ColumnType)
+		}
+		if err = c.deliver(ctx, handler, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliver retries handler until it handles event or ctx is done.
+func (c *CDC) deliver(ctx context.Context, handler CDCHandler, event *CDCEvent) error {
+	for attempt := 1; ; attempt++ {
+		err := handler.Handle(ctx, event)
+		if err == nil {
+			cdcTotals.WithLabelValues(c.options.name, event.Table, string(event.Action), "success").Inc()
+			cdcLag.WithLabelValues(c.options.name, event.Table).Observe(time.Since(event.Time).Seconds())
+			return nil
+		}
+		cdcTotals.WithLabelValues(c.options.name, event.Table, string(event.Action), "failure").Inc()
+		c.options.logger.Error("gormbox cdc handler error",
+			zap.String("cdc.table", event.Schema+"."+event.Table),
+			zap.String("cdc.action", string(event.Action)),
+			zap.String("cdc.position", event.Position.String()),
+			zap.Int("cdc.attempts", attempt),
+			zap.String("exception_msg", err.Error()),
+			zap.String("exception_type", "cdc"),
+		)
+
+		timer := time.NewTimer(backoffDelay(c.options.minBackoff, c.options.maxBackoff, attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+type cdcColumns struct {
+	names    []string
+	unsigned map[int]bool
+}
+
+func (c *CDC) tableColumns(ctx context.Context, table *replication.TableMapEvent) (*cdcColumns, error) {
+	if names := table.ColumnNameString(); len(names) > 0 {
+		return &cdcColumns{names: names, unsigned: table.UnsignedMap()}, nil
+	}
+
+	key := string(table.Schema) + "." + string(table.Table)
+	if columns, ok := c.columns[key]; ok {
+		return columns, nil
+	}
+	var rows []struct {
+		ColumnName string
+		ColumnType string
+	}
+	err := c.db.WithContext(WithoutTenant(ctx)).Raw("SELECT COLUMN_NAME AS column_name, COLUMN_TYPE AS column_type FROM information_schema.COLUMNS "+
+		"WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION", string(table.Schema), string(table.Table)).Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	columns := &cdcColumns{unsigned: make(map[int]bool)}
+	for i, row := range rows {
+		columns.names = append(columns.names, row.ColumnName)
+		columns.unsigned[i] = strings.Contains(strings.ToLower(row.ColumnType), "unsigned")
+	}
+	c.columns[key] = columns
+	return columns, nil
+}
+
+// row names the values of a row image of columns of types, values beyond the known columns are left out.
+func (columns *cdcColumns) row(values []interface{}, types []byte) map[string]interface{} {
+	row := make(map[string]interface{}, len(values))
+	for i, value := range values {
+		if i >= len(columns.names) {
+			break
+		}
+		if columns.unsigned[i] && i < len(types) {
+			value = cdcUnsigned(value, types[i])
+		}
+		row[columns.names[i]] = value
+	}
+	return row
+}
+
+// cdcUnsigned reads as unsigned the integers the binlog decodes as signed.
+func cdcUnsigned(value interface{}, typ byte) interface{} {
+	switch v := value.(type) {
+	case int8:
+		return uint8(v)
+	case int16:
+		return uint16(v)
+	case int32:
+		if typ == mysql.MYSQL_TYPE_INT24 {
+			// sign extended from 24 bits
+			return uint32(v) & 0xffffff
+		}
+		return uint32(v)
+	case int64:
+		return uint64(v)
+	}
+	return value
+}
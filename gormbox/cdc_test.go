@@ -0,0 +1,137 @@
+package gormbox
+
+import (
+	"context"
+	"errors"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"gorm.io/gorm/schema"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type cdcItem struct {
+	ID    int64
+	Name  string
+	Stock uint16
+}
+
+func cdcRows(eventType replication.EventType, pos uint32, table string, rows ...[]interface{}) *replication.BinlogEvent {
+	tableMap := &replication.TableMapEvent{
+		Schema:      []byte("shop"),
+		Table:       []byte(table),
+		ColumnCount: 3,
+		ColumnType:  []byte{mysql.MYSQL_TYPE_LONGLONG, mysql.MYSQL_TYPE_VARCHAR, mysql.MYSQL_TYPE_SHORT},
+		ColumnName:  [][]byte{[]byte("id"), []byte("name"), []byte("stock")},
+		// stock is unsigned
+		SignednessBitmap: []byte{0x40},
+	}
+	return &replication.BinlogEvent{
+		Header: &replication.EventHeader{EventType: eventType, LogPos: pos, Timestamp: uint32(time.Now().Unix())},
+		Event:  &replication.RowsEvent{Table: tableMap, Rows: rows},
+	}
+}
+
+func TestCDC_Consume(t *testing.T) {
+	db := sqliteDB(t)
+	c := NewCDC(db, &DSN{Driver: DriverMysql, DbName: "shop", Name: "test"},
+		CDCOptionLogger(zap.NewNop()), CDCOptionCheckpointInterval(0), CDCOptionBackoff(time.Millisecond, time.Millisecond))
+
+	var (
+		mu     sync.Mutex
+		events []*CDCEvent
+		failed bool
+	)
+	received := make(chan struct{}, 10)
+	c.Handle("items", CDCHandlerFunc(func(ctx context.Context, event *CDCEvent) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if !failed {
+			failed = true
+			return errors.New("index down")
+		}
+		events = append(events, event)
+		received <- struct{}{}
+		return nil
+	}))
+
+	stream := replication.NewBinlogStreamer()
+	for _, ev := range []*replication.BinlogEvent{
+		{Header: &replication.EventHeader{}, Event: &replication.RotateEvent{Position: 4, NextLogName: []byte("binlog.000002")}},
+		{Header: &replication.EventHeader{LogPos: 100}, Event: &replication.QueryEvent{Query: []byte("BEGIN")}},
+		cdcRows(replication.WRITE_ROWS_EVENTv2, 200, "items", []interface{}{int64(1), "apple", int16(-1)}),
+		cdcRows(replication.UPDATE_ROWS_EVENTv2, 300, "items", []interface{}{int64(1), "apple", int16(-1)}, []interface{}{int64(1), "pear", int16(3)}),
+		cdcRows(replication.WRITE_ROWS_EVENTv2, 400, "users", []interface{}{int64(1), "alice", int16(0)}),
+		{Header: &replication.EventHeader{LogPos: 500}, Event: &replication.XIDEvent{}},
+		{Header: &replication.EventHeader{LogPos: 550}, Event: &replication.QueryEvent{Query: []byte("BEGIN")}},
+		{Header: &replication.EventHeader{LogPos: 560}, Event: &replication.QueryEvent{Query: []byte("SAVEPOINT `sp1`")}},
+		// not committed, delivered again after a restart
+		cdcRows(replication.DELETE_ROWS_EVENTv2, 600, "items", []interface{}{int64(1), "pear", int16(3)}),
+	} {
+		require.NoError(t, stream.AddEventToStreamer(ev))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- c.consume(ctx, stream, CDCPosition{File: "binlog.000001", Pos: 4}) }()
+	for i := 0; i < 3; i++ {
+		<-received
+	}
+	cancel()
+	require.NoError(t, <-done)
+
+	require.Len(t, events, 3)
+	require.Equal(t, CDCInsert, events[0].Action)
+	require.Equal(t, map[string]interface{}{"id": int64(1), "name": "apple", "stock": uint16(65535)}, events[0].After)
+	require.Equal(t, CDCPosition{File: "binlog.000002", Pos: 200}, events[0].Position)
+
+	require.Equal(t, CDCUpdate, events[1].Action)
+	var before, after cdcItem
+	require.NoError(t, events[1].ScanBefore(&before))
+	require.NoError(t, events[1].ScanAfter(&after))
+	require.Equal(t, cdcItem{ID: 1, Name: "apple", Stock: 65535}, before)
+	require.Equal(t, cdcItem{ID: 1, Name: "pear", Stock: 3}, after)
+
+	require.Equal(t, CDCDelete, events[2].Action)
+	require.Nil(t, events[2].After)
+	require.Equal(t, "shop", events[2].Schema)
+
+	position, err := NewCDCTableCheckpoint(db, "gormbox_cdc_checkpoints", "test").Load(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, CDCPosition{File: "binlog.000002", Pos: 500}, position)
+}
+
+func TestCDCQuery(t *testing.T) {
+	cases := []struct {
+		query       string
+		commit, ddl bool
+	}{
+		{"BEGIN", false, false},
+		{"SAVEPOINT `sp1`", false, false},
+		{"ROLLBACK TO `sp1`", false, false},
+		{"INSERT INTO items VALUES (1)", false, false},
+		{"COMMIT", true, false},
+		{"XA COMMIT X'01'", true, false},
+		{"ALTER TABLE items ADD COLUMN price INT", true, true},
+		{"/* gh-ost */ rename table items TO items_old", true, true},
+	}
+	for _, c := range cases {
+		commit, ddl := cdcQuery(c.query)
+		require.Equal(t, c.commit, commit, c.query)
+		require.Equal(t, c.ddl, ddl, c.query)
+	}
+}
+
+func TestCDCEvent_ScanNaming(t *testing.T) {
+	db := sqliteDB(t)
+	db.NamingStrategy = schema.NamingStrategy{NameReplacer: strings.NewReplacer("Stock", "Quantity")}
+	event := &CDCEvent{After: map[string]interface{}{"id": int64(1), "name": "pear", "quantity": uint16(3)}, db: db}
+
+	var item cdcItem
+	require.NoError(t, event.ScanAfter(&item))
+	require.Equal(t, cdcItem{ID: 1, Name: "pear", Stock: 3}, item)
+}
@@ -0,0 +1,225 @@
+package gormbox
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+	"reflect"
+)
+
+const cursorDefaultLimit = 20
+
+var ErrInvalidCursor = errors.New("gormbox: invalid cursor")
+
+type CursorOrder struct {
+	Column string
+	Desc   bool
+}
+
+// CursorPage asks for Limit rows after the After cursor, or before the Before cursor, in Order.
+// Order should end with a unique column, the primary key is appended when it doesn't.
+// Columns of Order must not be null.
+type CursorPage struct {
+	Order  []CursorOrder
+	Limit  int
+	After  string
+	Before string
+}
+
+// CursorResult holds the cursors of the neighbour pages, a cursor is empty when there is no such page.
+type CursorResult struct {
+	Next string
+	Prev string
+}
+
+// cursor is base64 encoded json, it is bound to the operation and the order it was issued for.
+type cursor struct {
+	Operation string            `json:"op"`
+	Columns   []string          `json:"cols"`
+	Values    []json.RawMessage `json:"vals"`
+}
+
+// CursorPaginate finds a page of rows into dest, a pointer to a slice of models, seeking by the values
+// of the order columns instead of an offset. db carries the conditions of the query and its context,
+// cursors issued by one operation, see WithOperation, are refused by another.
+func CursorPaginate(db *gorm.DB, dest interface{}, page CursorPage) (*CursorResult, error) {
+	if page.After != "" && page.Before != "" {
+		return nil, fmt.Errorf("%w: both after and before", ErrInvalidCursor)
+	}
+	if page.Limit <= 0 {
+		page.Limit = cursorDefaultLimit
+	}
+
+	rows := reflect.ValueOf(dest)
+	if rows.Kind() != reflect.Ptr || rows.Elem().Kind() != reflect.Slice {
+		return nil, fmt.Errorf("gormbox: cursor paginate into %T, want a pointer to a slice", dest)
+	}
+	rows = rows.Elem()
+
+	tx := db.Session(&gorm.Session{})
+	model := tx.Statement.Model
+	if model == nil {
+		model = dest
+	}
+	stmt := &gorm.Statement{DB: tx}
+	if err := stmt.Parse(model); err != nil {
+		return nil, err
+	}
+	fields, err := cursorFields(stmt.Schema, page.Order)
+	if err != nil {
+		return nil, err
+	}
+	columns := make([]string, 0, len(fields))
+	for i, field := range fields {
+		columns = append(columns, cursorColumn(field.DBName, page.Order, i))
+	}
+	descs := make([]bool, len(fields))
+	for i := range page.Order {
+		descs[i] = page.Order[i].Desc
+	}
+
+	operation := OperationFrom(tx.Statement.Context)
+
+	backward := page.Before != ""
+	if raw := page.After + page.Before; raw != "" {
+		values, err := decodeCursor(raw, operation, columns, fields)
+		if err != nil {
+			return nil, err
+		}
+		tx = tx.Where(cursorCondition(fields, descs, values, backward))
+	}
+	for i, field := range fields {
+		tx = tx.Order(clause.OrderByColumn{Column: clause.Column{Table: clause.CurrentTable, Name: field.DBName}, Desc: descs[i] != backward})
+	}
+	if err = tx.Limit(page.Limit + 1).Find(dest).Error; err != nil {
+		return nil, err
+	}
+
+	more := rows.Len() > page.Limit
+	if more {
+		rows.Set(rows.Slice(0, page.Limit))
+	}
+	if backward {
+		swap := reflect.Swapper(rows.Interface())
+		for i, j := 0, rows.Len()-1; i < j; i, j = i+1, j-1 {
+			swap(i, j)
+		}
+	}
+
+	result := &CursorResult{}
+	if rows.Len() == 0 {
+		return result, nil
+	}
+	encode := func(row reflect.Value) (string, error) {
+		return encodeCursor(tx.Statement.Context, operation, columns, fields, reflect.Indirect(row))
+	}
+	if more || page.Before != "" {
+		if result.Next, err = encode(rows.Index(rows.Len() - 1)); err != nil {
+			return nil, err
+		}
+	}
+	if (backward && more) || page.After != "" {
+		if result.Prev, err = encode(rows.Index(0)); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// cursorFields resolves the order columns, appending the primary key when it isn't ordered by.
+func cursorFields(s *schema.Schema, order []CursorOrder) ([]*schema.Field, error) {
+	fields := make([]*schema.Field, 0, len(order)+1)
+	seen := make(map[string]bool, len(order))
+	for _, o := range order {
+		field := s.LookUpField(o.Column)
+		if field == nil || field.DBName == "" {
+			return nil, fmt.Errorf("gormbox: cursor order by unknown column %s of %s", o.Column, s.Table)
+		}
+		fields = append(fields, field)
+		seen[field.DBName] = true
+	}
+	if pk := s.PrioritizedPrimaryField; pk != nil && !seen[pk.DBName] {
+		fields = append(fields, pk)
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("gormbox: cursor without order on %s", s.Table)
+	}
+	return fields, nil
+}
+
+func cursorColumn(name string, order []CursorOrder, i int) string {
+	if i < len(order) && order[i].Desc {
+		return name + " desc"
+	}
+	return name
+}
+
+// cursorCondition seeks past values: (a > ?) OR (a = ? AND b > ?) OR ..., the comparisons flip for
+// descending columns and when paging backward.
+func cursorCondition(fields []*schema.Field, descs []bool, values []interface{}, backward bool) clause.Expression {
+	ors := make([]clause.Expression, 0, len(fields))
+	for i, field := range fields {
+		ands := make([]clause.Expression, 0, i+1)
+		for j := 0; j < i; j++ {
+			ands = append(ands, clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: fields[j].DBName}, Value: values[j]})
+		}
+		column := clause.Column{Table: clause.CurrentTable, Name: field.DBName}
+		if descs[i] != backward {
+			ands = append(ands, clause.Lt{Column: column, Value: values[i]})
+		} else {
+			ands = append(ands, clause.Gt{Column: column, Value: values[i]})
+		}
+		ors = append(ors, clause.And(ands...))
+	}
+	return clause.Or(ors...)
+}
+
+func encodeCursor(ctx context.Context, operation string, columns []string, fields []*schema.Field, row reflect.Value) (string, error) {
+	c := cursor{Operation: operation, Columns: columns, Values: make([]json.RawMessage, 0, len(fields))}
+	for _, field := range fields {
+		value, _ := field.ValueOf(ctx, row)
+		data, err := json.Marshal(value)
+		if err != nil {
+			return "", err
+		}
+		c.Values = append(c.Values, data)
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// decodeCursor checks that raw was issued for the same operation and order, and decodes its values into the field types.
+func decodeCursor(raw, operation string, columns []string, fields []*schema.Field) ([]interface{}, error) {
+	data, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidCursor, err)
+	}
+	var c cursor
+	if err = json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidCursor, err)
+	}
+	if c.Operation != operation {
+		return nil, fmt.Errorf("%w: issued for operation %q", ErrInvalidCursor, c.Operation)
+	}
+	if !reflect.DeepEqual(c.Columns, columns) || len(c.Values) != len(fields) {
+		return nil, fmt.Errorf("%w: issued for another order", ErrInvalidCursor)
+	}
+
+	values := make([]interface{}, 0, len(fields))
+	for i, field := range fields {
+		value := reflect.New(field.FieldType)
+		if err = json.Unmarshal(c.Values[i], value.Interface()); err != nil {
+			return nil, fmt.Errorf("%w: %s %s", ErrInvalidCursor, field.DBName, err)
+		}
+		values = append(values, value.Elem().Interface())
+	}
+	return values, nil
+}
@@ -0,0 +1,72 @@
+package gormbox
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+type cursorItem struct {
+	ID    int64
+	Score int
+}
+
+func TestCursorPaginate(t *testing.T) {
+	db := sqliteDB(t)
+	require.NoError(t, db.AutoMigrate(&cursorItem{}))
+	require.NoError(t, db.Create(&[]cursorItem{{1, 50}, {2, 70}, {3, 50}, {4, 90}, {5, 10}, {6, 70}, {7, 30}}).Error)
+
+	ctx := WithOperation(context.Background(), "item.list")
+	order := []CursorOrder{{Column: "score", Desc: true}}
+	ids := func(items []cursorItem) []int64 {
+		var ids []int64
+		for _, item := range items {
+			ids = append(ids, item.ID)
+		}
+		return ids
+	}
+
+	var items []cursorItem
+	page, err := CursorPaginate(db.WithContext(ctx), &items, CursorPage{Order: order, Limit: 3})
+	require.NoError(t, err)
+	require.Equal(t, []int64{4, 2, 6}, ids(items))
+	require.Empty(t, page.Prev)
+	require.NotEmpty(t, page.Next)
+
+	items = nil
+	page, err = CursorPaginate(db.WithContext(ctx), &items, CursorPage{Order: order, Limit: 3, After: page.Next})
+	require.NoError(t, err)
+	require.Equal(t, []int64{1, 3, 7}, ids(items))
+	require.NotEmpty(t, page.Prev)
+	second := page
+
+	items = nil
+	page, err = CursorPaginate(db.WithContext(ctx), &items, CursorPage{Order: order, Limit: 3, After: page.Next})
+	require.NoError(t, err)
+	require.Equal(t, []int64{5}, ids(items))
+	require.Empty(t, page.Next)
+
+	items = nil
+	page, err = CursorPaginate(db.WithContext(ctx), &items, CursorPage{Order: order, Limit: 3, Before: page.Prev})
+	require.NoError(t, err)
+	require.Equal(t, []int64{1, 3, 7}, ids(items))
+	require.Equal(t, second.Next, page.Next)
+
+	items = nil
+	page, err = CursorPaginate(db.WithContext(ctx), &items, CursorPage{Order: order, Limit: 3, Before: page.Prev})
+	require.NoError(t, err)
+	require.Equal(t, []int64{4, 2, 6}, ids(items))
+	require.Empty(t, page.Prev)
+
+	items = nil
+	_, err = CursorPaginate(db.WithContext(ctx).Where("score > ?", 20), &items, CursorPage{Order: order, Limit: 2, After: second.Prev})
+	require.NoError(t, err)
+	require.Equal(t, []int64{3, 7}, ids(items))
+
+	_, err = CursorPaginate(db.WithContext(WithOperation(context.Background(), "other")), &items, CursorPage{Order: order, After: second.Next})
+	require.ErrorIs(t, err, ErrInvalidCursor)
+	_, err = CursorPaginate(db.WithContext(ctx), &items, CursorPage{After: second.Next})
+	require.ErrorIs(t, err, ErrInvalidCursor)
+	_, err = CursorPaginate(db.WithContext(ctx), &items, CursorPage{Order: order, After: "not a cursor"})
+	require.ErrorIs(t, err, ErrInvalidCursor)
+}
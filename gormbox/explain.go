@@ -0,0 +1,276 @@
+package gormbox
+
+import (
+	"context"
+	"database/sql"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	explainSetting = "gormbox:explain"
+	explainTimeout = 5 * time.Second
+)
+
+type ExplainRow struct {
+	Table string
+	Type  string
+	Key   string
+	Rows  int64
+}
+
+type ExplainPlan []ExplainRow
+
+func (plan ExplainPlan) Type() string {
+	return plan.join(func(row ExplainRow) string { return row.Type })
+}
+
+func (plan ExplainPlan) Key() string {
+	return plan.join(func(row ExplainRow) string { return row.Key })
+}
+
+func (plan ExplainPlan) Rows() int64 {
+	var rows int64
+	for _, row := range plan {
+		rows += row.Rows
+	}
+	return rows
+}
+
+func (plan ExplainPlan) join(field func(ExplainRow) string) string {
+	values := make([]string, 0, len(plan))
+	for _, row := range plan {
+		values = append(values, field(row))
+	}
+	return strings.Join(values, ",")
+}
+
+type explainer func(ctx context.Context, pool gorm.ConnPool, query string, vars ...interface{}) (ExplainPlan, error)
+
+var explainers = map[string]explainer{
+	DriverMysql:      explainMysql,
+	DriverClickhouse: explainClickhouse,
+}
+
+func explainable(driver, query string) bool {
+	verb := strings.ToUpper(strings.SplitN(strings.TrimSpace(query), " ", 2)[0])
+	switch driver {
+	case DriverMysql:
+		return verb == "SELECT" || verb == "UPDATE" || verb == "DELETE"
+	case DriverClickhouse:
+		return verb == "SELECT"
+	}
+	return false
+}
+
+func explainMysql(ctx context.Context, pool gorm.ConnPool, query string, vars ...interface{}) (ExplainPlan, error) {
+	rows, err := pool.QueryContext(ctx, "EXPLAIN "+query, vars...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var records []map[string]string
+	for rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err = rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		record := make(map[string]string, len(columns))
+		for i, column := range columns {
+			record[strings.ToLower(column)] = values[i].String
+		}
+		records = append(records, record)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return mysqlExplainPlan(records), nil
+}
+
+func mysqlExplainPlan(records []map[string]string) ExplainPlan {
+	plan := make(ExplainPlan, 0, len(records))
+	for _, record := range records {
+		row := ExplainRow{Table: record["table"], Type: record["type"], Key: record["key"]}
+		if row.Key == "" {
+			row.Key = "NULL"
+		}
+		row.Rows, _ = strconv.ParseInt(record["rows"], 10, 64)
+		plan = append(plan, row)
+	}
+	return plan
+}
+
+func explainClickhouse(ctx context.Context, pool gorm.ConnPool, query string, vars ...interface{}) (ExplainPlan, error) {
+	rows, err := pool.QueryContext(ctx, "EXPLAIN indexes = 1 "+query, vars...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lines []string
+	for rows.Next() {
+		var line string
+		if err = rows.Scan(&line); err != nil {
+			return nil, err
+		}
+		lines = append(lines, line)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return clickhouseExplainPlan(lines), nil
+}
+
+// clickhouseExplainPlan summarizes the output of `EXPLAIN indexes = 1`: the type is the top level step,
+// the key lists the index keys that were used and the rows are the number of selected granules.
+func clickhouseExplainPlan(lines []string) ExplainPlan {
+	var (
+		row    ExplainRow
+		keys   []string
+		inKeys bool
+	)
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if i == 0 {
+			row.Type = line
+		}
+		switch {
+		case line == "Keys:":
+			inKeys = true
+			continue
+		case strings.HasPrefix(line, "Granules:"):
+			selected := strings.SplitN(strings.TrimSpace(strings.TrimPrefix(line, "Granules:")), "/", 2)[0]
+			row.Rows, _ = strconv.ParseInt(selected, 10, 64)
+		}
+		if inKeys {
+			if strings.Contains(line, ":") {
+				inKeys = false
+			} else {
+				keys = append(keys, line)
+			}
+		}
+	}
+	row.Key = strings.Join(keys, " ")
+	if row.Key == "" {
+		row.Key = "NULL"
+	}
+	return ExplainPlan{row}
+}
+
+// InterceptorExplain runs EXPLAIN on the statements slower than threshold, at most once per interval and one at
+// a time, off the path of the statement: on a connection of its own to the db that ran it, once it returned.
+// InterceptorLogging flags the log entry of the statement as a slow query, the plan arrives later in a
+// "gormbox explain" entry and an "<operation>.explain" span, a child of the statement span, of the same trace.
+func InterceptorExplain(dsn *DSN, logger *zap.Logger, threshold, interval time.Duration) Interceptor {
+	var (
+		tracer   = otel.Tracer(dsn.Driver)
+		explain  = explainers[dsn.Driver]
+		last     int64
+		inflight = make(chan struct{}, 1)
+	)
+	// allow at most one EXPLAIN per interval
+	acquire := func() bool {
+		now := time.Now().UnixNano()
+		prev := atomic.LoadInt64(&last)
+		return now-prev >= int64(interval) && atomic.CompareAndSwapInt64(&last, prev, now)
+	}
+
+	return func(action string, next Handler) Handler {
+		return func(db *gorm.DB) {
+			var (
+				ctx       context.Context
+				operation string
+				st        = time.Now()
+			)
+			if ctx = db.Statement.Context; ctx == nil || explain == nil {
+				next(db)
+				return
+			}
+			if operation = OperationFrom(ctx); operation == "" {
+				next(db)
+				return
+			}
+
+			next(db)
+
+			latency := time.Since(st)
+			query := db.Statement.SQL.String()
+			if latency < threshold || db.Statement.Error != nil || !explainable(dsn.Driver, query) || !acquire() {
+				return
+			}
+			// the pool of the db that ran the statement, a replica or the one under its transaction
+			sqlDB, err := db.DB()
+			if err != nil {
+				return
+			}
+			select {
+			case inflight <- struct{}{}:
+			default:
+				return
+			}
+			// picked up by InterceptorLogging
+			db.InstanceSet(explainSetting, true)
+
+			var (
+				vars      = append([]interface{}(nil), db.Statement.Vars...)
+				statement = detailSQL(db)
+				spanCtx   = trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(ctx))
+			)
+			go func() {
+				defer func() { <-inflight }()
+				ctx, cancel := context.WithTimeout(spanCtx, explainTimeout)
+				defer cancel()
+
+				var plan ExplainPlan
+				conn, err := sqlDB.Conn(ctx)
+				if err == nil {
+					plan, err = explain(ctx, conn, query, vars...)
+					_ = conn.Close()
+				}
+
+				_, span := tracer.Start(spanCtx, operation+".explain",
+					trace.WithLinks(trace.Link{SpanContext: trace.SpanContextFromContext(spanCtx)}))
+				defer span.End()
+				fields := []zap.Field{
+					zap.String("db.operation", operation),
+					zap.String("db.statement", statement),
+					zap.Duration("latency", latency),
+					zap.String("trace_id", trace.SpanContextFromContext(spanCtx).TraceID().String()),
+					zap.String("span_id", trace.SpanContextFromContext(spanCtx).SpanID().String()),
+				}
+				if err != nil {
+					span.AddEvent("db.explain", trace.WithAttributes(attribute.String("db.explain.error", err.Error())))
+					logger.Warn("gormbox explain", append(fields, zap.String("explain_error", err.Error()))...)
+					return
+				}
+				span.AddEvent("db.explain", trace.WithAttributes(
+					attribute.String("db.explain.type", plan.Type()),
+					attribute.String("db.explain.key", plan.Key()),
+					attribute.Int64("db.explain.rows", plan.Rows()),
+					attribute.String("db.latency", latency.String()),
+				))
+				logger.Warn("gormbox explain", append(fields,
+					zap.String("explain_type", plan.Type()),
+					zap.String("explain_key", plan.Key()),
+					zap.Int64("explain_rows", plan.Rows()),
+				)...)
+			}()
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package gormbox
+
+import (
+	"context"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"testing"
+	"time"
+)
+
+func TestMysqlExplainPlan(t *testing.T) {
+	plan := mysqlExplainPlan([]map[string]string{
+		{"table": "user", "type": "ALL", "key": "", "rows": "1000"},
+		{"table": "order", "type": "ref", "key": "idx_user_id", "rows": "3"},
+	})
+	require.Equal(t, "ALL,ref", plan.Type())
+	require.Equal(t, "NULL,idx_user_id", plan.Key())
+	require.Equal(t, int64(1003), plan.Rows())
+}
+
+func TestClickhouseExplainPlan(t *testing.T) {
+	plan := clickhouseExplainPlan([]string{
+		"Expression ((Projection + Before ORDER BY))",
+		"  ReadFromMergeTree (default.events)",
+		"  Indexes:",
+		"    PrimaryKey",
+		"      Keys:",
+		"        user_id",
+		"        event_time",
+		"      Condition: (user_id in [42, 42])",
+		"      Parts: 1/3",
+		"      Granules: 2/120",
+	})
+	require.Equal(t, "Expression ((Projection + Before ORDER BY))", plan.Type())
+	require.Equal(t, "user_id event_time", plan.Key())
+	require.Equal(t, int64(2), plan.Rows())
+}
+
+func TestExplainable(t *testing.T) {
+	require.True(t, explainable(DriverMysql, "SELECT * FROM user"))
+	require.True(t, explainable(DriverMysql, "update user set name = ?"))
+	require.False(t, explainable(DriverMysql, "INSERT INTO user VALUES (?)"))
+	require.False(t, explainable(DriverClickhouse, "ALTER TABLE events DELETE WHERE 1"))
+}
+
+func TestInterceptorExplain(t *testing.T) {
+	db, mock := mockDB(t)
+	// the EXPLAIN runs in the background
+	mock.MatchExpectationsInOrder(false)
+	core, logs := observer.New(zapcore.InfoLevel)
+	dsn := &DSN{Driver: DriverMysql}
+	Intercept(db, InterceptorExplain(dsn, zap.New(core), time.Nanosecond, time.Hour), InterceptorLogging(dsn, zap.New(core)))
+	ctx := WithOperation(context.Background(), "user.get")
+
+	mock.ExpectQuery("^SELECT \\* FROM `audit_users` WHERE id = \\?").WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "age"}).AddRow(1, "bob", 20))
+	mock.ExpectQuery("^EXPLAIN SELECT \\* FROM `audit_users` WHERE id = \\?").WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"table", "type", "key", "rows"}).AddRow("audit_users", "const", "PRIMARY", 1))
+	var user auditUser
+	require.NoError(t, db.WithContext(ctx).Where("id = ?", 1).Find(&user).Error)
+
+	// rate limited to one per interval
+	mock.ExpectQuery("^SELECT \\* FROM `audit_users`").WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "age"}).AddRow(2, "alice", 30))
+	require.NoError(t, db.WithContext(ctx).Where("id = ?", 2).Find(&auditUser{}).Error)
+
+	require.Eventually(t, func() bool { return logs.FilterMessage("gormbox explain").Len() == 1 }, time.Second, 10*time.Millisecond)
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	entries := logs.FilterMessageSnippet("db.operation=user.get").All()
+	require.Len(t, entries, 2)
+	require.Equal(t, zapcore.WarnLevel, entries[0].Level)
+	require.Equal(t, "true", entries[0].ContextMap()["slow_query"])
+	require.Equal(t, zapcore.InfoLevel, entries[1].Level)
+	require.NotContains(t, entries[1].ContextMap(), "slow_query")
+
+	explained := logs.FilterMessage("gormbox explain").All()[0].ContextMap()
+	require.Equal(t, "user.get", explained["db.operation"])
+	require.Equal(t, "SELECT * FROM `audit_users` WHERE id = 1", explained["db.statement"])
+	require.Equal(t, "const", explained["explain_type"])
+	require.Equal(t, "PRIMARY", explained["explain_key"])
+	require.Equal(t, int64(1), explained["explain_rows"])
+}
@@ -0,0 +1,169 @@
+package gormbox
+
+import (
+	"gorm.io/gorm"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	fingerprintSetting   = "gormbox:fingerprint"
+	fingerprintOther     = "other"
+	fingerprintMaxLength = 256
+)
+
+var (
+	fingerprintInList = regexp.MustCompile(`\bin ?\(\?(?: ?, ?\?)*\)`)
+	fingerprintValues = regexp.MustCompile(`\bvalues ?\(\?(?: ?, ?\?)*\)(?: ?, ?\(\?(?: ?, ?\?)*\))*`)
+	fingerprintArray  = regexp.MustCompile(`\[\?(?: ?, ?\?)*\]`)
+)
+
+// Fingerprint normalizes a statement so that statements differing only in literal values share the same text:
+// literals become '?', comments are dropped, whitespace is collapsed and IN / VALUES lists are folded.
+// In mysql double quotes delimit strings, in clickhouse they delimit identifiers and {name:Type} are parameters.
+func Fingerprint(driver, query string) string {
+	var (
+		b     strings.Builder
+		runes = []rune(query)
+		space bool
+	)
+	b.Grow(len(query))
+
+	write := func(r rune) {
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+		b.WriteRune(unicode.ToLower(r))
+	}
+
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			space = true
+		case r == '\'' || (r == '"' && driver != DriverClickhouse):
+			i = skipQuoted(runes, i, r)
+			write('?')
+		case r == '{' && driver == DriverClickhouse:
+			for i < len(runes) && runes[i] != '}' {
+				i++
+			}
+			write('?')
+		case r == '`' || r == '"':
+			end := skipQuoted(runes, i, r)
+			for _, c := range runes[i : end+1] {
+				write(c)
+			}
+			i = end
+		case r == '#' && driver != DriverClickhouse, r == '-' && i+1 < len(runes) && runes[i+1] == '-':
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+			space = true
+		case r == '/' && i+1 < len(runes) && runes[i+1] == '*':
+			for i += 2; i+1 < len(runes) && !(runes[i] == '*' && runes[i+1] == '/'); i++ {
+			}
+			i++
+			space = true
+		case unicode.IsDigit(r) && !identifierRune(runes, i-1):
+			for i+1 < len(runes) && (unicode.IsDigit(runes[i+1]) || runes[i+1] == '.' || runes[i+1] == 'e' || runes[i+1] == 'x' ||
+				('a' <= unicode.ToLower(runes[i+1]) && unicode.ToLower(runes[i+1]) <= 'f')) {
+				i++
+			}
+			write('?')
+		default:
+			write(r)
+		}
+	}
+
+	fp := fingerprintInList.ReplaceAllString(b.String(), "in (?+)")
+	fp = fingerprintValues.ReplaceAllString(fp, "values (?+)")
+	if driver == DriverClickhouse {
+		fp = fingerprintArray.ReplaceAllString(fp, "[?+]")
+	}
+	return fp
+}
+
+// skipQuoted returns the index of the quote closing the one at start, honoring backslash and doubled quote escapes.
+func skipQuoted(runes []rune, start int, quote rune) int {
+	for i := start + 1; i < len(runes); i++ {
+		switch runes[i] {
+		case '\\':
+			i++
+		case quote:
+			if i+1 < len(runes) && runes[i+1] == quote {
+				i++
+				continue
+			}
+			return i
+		}
+	}
+	return len(runes) - 1
+}
+
+func identifierRune(runes []rune, i int) bool {
+	if i < 0 {
+		return false
+	}
+	r := runes[i]
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '$'
+}
+
+// fingerprintTruncate cuts fp to fingerprintMaxLength bytes on a rune boundary, the metric labels
+// have to be valid utf-8.
+func fingerprintTruncate(fp string) string {
+	if len(fp) <= fingerprintMaxLength {
+		return fp
+	}
+	n := fingerprintMaxLength
+	for n > 0 && !utf8.RuneStart(fp[n]) {
+		n--
+	}
+	return fp[:n]
+}
+
+// InterceptorFingerprint counts statements by fingerprint, it doesn't depend on WithOperation.
+// At most maxFingerprints distinct fingerprints become metric labels, the rest are counted as "other".
+func InterceptorFingerprint(dsn *DSN, maxFingerprints int) Interceptor {
+	var (
+		mu   sync.Mutex
+		seen = make(map[string]struct{})
+	)
+	label := func(fp string) string {
+		fp = fingerprintTruncate(fp)
+		mu.Lock()
+		defer mu.Unlock()
+		if _, ok := seen[fp]; ok {
+			return fp
+		}
+		if len(seen) >= maxFingerprints {
+			return fingerprintOther
+		}
+		seen[fp] = struct{}{}
+		return fp
+	}
+
+	return func(action string, next Handler) Handler {
+		return func(db *gorm.DB) {
+			st := time.Now()
+
+			next(db)
+
+			fp := Fingerprint(dsn.Driver, db.Statement.SQL.String())
+			if fp == "" {
+				return
+			}
+			// picked up by InterceptorLogging
+			db.InstanceSet(fingerprintSetting, fp)
+
+			fpLabel := label(fp)
+			fingerprintTotals.WithLabelValues(dsn.Name, dsn.Addr, dsn.DbName, fpLabel).Inc()
+			fingerprintLatency.WithLabelValues(dsn.Name, dsn.Addr, dsn.DbName, fpLabel).Observe(time.Since(st).Seconds())
+		}
+	}
+}
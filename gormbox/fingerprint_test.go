@@ -0,0 +1,38 @@
+package gormbox
+
+import (
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestFingerprint(t *testing.T) {
+	cases := []struct {
+		driver string
+		query  string
+		expect string
+	}{
+		{DriverMysql, "SELECT *  FROM `user`\n WHERE id = 42 AND name = 'it''s'", "select * from `user` where id = ? and name = ?"},
+		{DriverMysql, `select * from user where name = "tom" # comment`, "select * from user where name = ?"},
+		{DriverMysql, "select * from user where id IN (1, 2, 3) and t1.c2 = 0x1F /* comment */", "select * from user where id in (?+) and t1.c2 = ?"},
+		{DriverMysql, "INSERT INTO user (id,name) VALUES (?,?),(?,?)", "insert into user (id,name) values (?+)"},
+		{DriverClickhouse, `SELECT "user_id" FROM events WHERE id IN (1,2) AND tags = ['a', 'b']`, `select "user_id" from events where id in (?+) and tags = [?+]`},
+		{DriverClickhouse, "SELECT * FROM events WHERE day = {day:Date} -- comment", "select * from events where day = ?"},
+	}
+	for _, c := range cases {
+		require.Equal(t, c.expect, Fingerprint(c.driver, c.query), c.query)
+	}
+}
+
+func TestInterceptorFingerprint_Truncate(t *testing.T) {
+	// the multibyte identifier straddles the cut
+	query := "select `" + strings.Repeat("a", fingerprintMaxLength-9) + "数据` from t"
+	fp := fingerprintTruncate(Fingerprint(DriverMysql, query))
+	require.True(t, utf8.ValidString(fp))
+	require.Equal(t, "select `"+strings.Repeat("a", fingerprintMaxLength-9), fp)
+
+	db, _ := dryRunDB(t)
+	Intercept(db, InterceptorFingerprint(&DSN{Driver: DriverMysql}, 10))
+	require.NotPanics(t, func() { db.Exec(query) })
+}
@@ -25,6 +25,11 @@ func IsRecordDuplicate(err error) bool {
 	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
 }
 
+// IsStaleObject tells whether err comes from the update of a record changed since it was read, see ErrStaleObject.
+func IsStaleObject(err error) bool {
+	return errors.Is(err, ErrStaleObject)
+}
+
 func IsRecordNotFound(err error) bool {
 	return errors.Is(err, gorm.ErrRecordNotFound)
 }
@@ -0,0 +1,60 @@
+package gormboxtest
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"gorm.io/gorm"
+	"io/fs"
+	"testing"
+)
+
+// LoadFixtures inserts the rows of files, read from fsys, into their tables. A file maps tables to rows
+// in yaml or json, tables are filled in the order of the file:
+//
+//	users:
+//	  - {id: 1, name: alice}
+//	orders:
+//	  - {id: 1, user_id: 1, amount: 100}
+func LoadFixtures(db *gorm.DB, fsys fs.FS, files ...string) error {
+	for _, file := range files {
+		data, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return err
+		}
+		// json is yaml, and yaml.Node keeps the order of the tables
+		var doc yaml.Node
+		if err = yaml.Unmarshal(data, &doc); err != nil {
+			return fmt.Errorf("gormboxtest: fixture %s: %w", file, err)
+		}
+		if len(doc.Content) == 0 {
+			continue
+		}
+		tables := doc.Content[0]
+		if tables.Kind != yaml.MappingNode {
+			return fmt.Errorf("gormboxtest: fixture %s: want a mapping of tables to rows", file)
+		}
+
+		for i := 0; i+1 < len(tables.Content); i += 2 {
+			table := tables.Content[i].Value
+			var rows []map[string]interface{}
+			if err = tables.Content[i+1].Decode(&rows); err != nil {
+				return fmt.Errorf("gormboxtest: fixture %s table %s: %w", file, table, err)
+			}
+			if len(rows) == 0 {
+				continue
+			}
+			if err = db.Table(table).Create(&rows).Error; err != nil {
+				return fmt.Errorf("gormboxtest: fixture %s table %s: %w", file, table, err)
+			}
+		}
+	}
+	return nil
+}
+
+func MustLoadFixtures(t testing.TB, db *gorm.DB, fsys fs.FS, files ...string) {
+	t.Helper()
+
+	if err := LoadFixtures(db, fsys, files...); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,64 @@
+// Package gormboxtest runs gormbox dbs on sqlite in memory for tests, with fixtures, rolled back
+// transactions and assertions on the statements executed.
+package gormboxtest
+
+import (
+	"github.com/glebarez/sqlite"
+	"github.com/lyouthzzz/gobox/gormbox"
+	"go.uber.org/zap/zaptest"
+	"gorm.io/gorm"
+	"testing"
+)
+
+const DriverSqlite = "sqlite"
+
+func init() {
+	gormbox.RegisterParser(DriverSqlite, &sqliteParser{})
+}
+
+type sqliteParser struct{}
+
+func (parser *sqliteParser) GetDialector(dsn string) gorm.Dialector {
+	return sqlite.Open(dsn)
+}
+
+func (parser *sqliteParser) ParseDSN(dsn string) (*gormbox.DSN, error) {
+	return &gormbox.DSN{Driver: DriverSqlite, Net: "file", Addr: dsn, DbName: "main"}, nil
+}
+
+func (parser *sqliteParser) FormatDSN(dsn *gormbox.DSN) (string, error) {
+	return dsn.Addr, nil
+}
+
+// NewDB builds a gormbox db with opts on a database of its own in memory, closed when t ends.
+// It logs through t, pass gormbox.OptionLogger to log elsewhere.
+// The db holds a single connection, which is what keeps the database alive: don't use the db
+// while a transaction of it is open, use the transaction.
+func NewDB(t testing.TB, opts ...gormbox.Option) *gorm.DB {
+	t.Helper()
+
+	config := gormbox.DefaultConfig().WithDriver(DriverSqlite).WithDSN(":memory:")
+	config.MaxOpenConns = 1
+	db, err := config.Build(append([]gormbox.Option{gormbox.OptionLogger(zaptest.NewLogger(t))}, opts...)...)
+	if err != nil {
+		t.Fatalf("gormboxtest: build db: %s", err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatalf("gormboxtest: build db: %s", err)
+	}
+	t.Cleanup(func() { _ = sqlDB.Close() })
+	return db
+}
+
+// Tx begins a transaction on db that is rolled back when t ends, whatever the test wrote is gone for the next one.
+func Tx(t testing.TB, db *gorm.DB) *gorm.DB {
+	t.Helper()
+
+	tx := db.Begin()
+	if tx.Error != nil {
+		t.Fatalf("gormboxtest: begin: %s", tx.Error)
+	}
+	t.Cleanup(func() { tx.Rollback() })
+	return tx
+}
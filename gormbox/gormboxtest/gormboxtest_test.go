@@ -0,0 +1,81 @@
+package gormboxtest_test
+
+import (
+	"context"
+	"github.com/lyouthzzz/gobox/gormbox"
+	"github.com/lyouthzzz/gobox/gormbox/gormboxtest"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"testing/fstest"
+)
+
+type user struct {
+	ID   int64
+	Name string
+}
+
+type order struct {
+	ID     int64
+	UserID int64
+	Amount int
+}
+
+var fixtures = fstest.MapFS{
+	"users.yaml":  {Data: []byte("users:\n  - {id: 1, name: alice}\n  - {id: 2, name: bob}\n")},
+	"orders.json": {Data: []byte(`{"orders": [{"id": 1, "user_id": 1, "amount": 100}, {"id": 2, "user_id": 2, "amount": 50}]}`)},
+}
+
+func TestNewDB(t *testing.T) {
+	db := gormboxtest.NewDB(t, gormbox.OptionName("test"))
+	require.NoError(t, db.AutoMigrate(&user{}, &order{}))
+	gormboxtest.MustLoadFixtures(t, db, fixtures, "users.yaml", "orders.json")
+
+	t.Run("rolled back", func(t *testing.T) {
+		tx := gormboxtest.Tx(t, db)
+		require.NoError(t, tx.Where("id = ?", 1).Delete(&user{}).Error)
+		var count int64
+		require.NoError(t, tx.Model(&user{}).Count(&count).Error)
+		require.Equal(t, int64(1), count)
+	})
+
+	var users []user
+	require.NoError(t, db.Order("id").Find(&users).Error)
+	require.Equal(t, []user{{1, "alice"}, {2, "bob"}}, users)
+}
+
+func TestRecorder(t *testing.T) {
+	db := gormboxtest.NewDB(t)
+	require.NoError(t, db.AutoMigrate(&order{}))
+	gormboxtest.MustLoadFixtures(t, db, fixtures, "orders.json")
+
+	recorder := gormboxtest.Record(db)
+	ctx := gormbox.WithOperation(context.Background(), "order.list")
+	var orders []order
+	require.NoError(t, db.WithContext(ctx).Where("amount > ?", 60).Find(&orders).Error)
+	require.Len(t, orders, 1)
+
+	recorder.AssertSQL(t, "SELECT * FROM `orders` WHERE amount > ?")
+	recorder.AssertCount(t, 1)
+	recorder.AssertContains(t, "amount >")
+	recorder.AssertNoErrors(t)
+	require.Equal(t, []interface{}{60}, recorder.Statements()[0].Vars)
+
+	recorder.Reset()
+	require.Error(t, db.Exec("SELECT * FROM missing").Error)
+	require.Len(t, recorder.Statements(), 1)
+	require.Error(t, recorder.Statements()[0].Err)
+}
+
+func TestAssertGolden(t *testing.T) {
+	db := gormboxtest.NewDB(t, gormbox.OptionRecorder())
+	require.NoError(t, db.AutoMigrate(&order{}))
+	gormboxtest.MustLoadFixtures(t, db, fixtures, "orders.json")
+
+	recorder := gormbox.NewRecorder(0)
+	ctx := gormbox.WithRecorder(gormbox.WithOperation(context.Background(), "order.list"), recorder)
+	var orders []order
+	require.NoError(t, db.WithContext(ctx).Where("user_id = ?", 1).Find(&orders).Error)
+	require.NoError(t, db.WithContext(ctx).Model(&order{}).Where("id = ?", 2).Update("amount", 70).Error)
+
+	gormboxtest.AssertGolden(t, recorder, "testdata/orders.golden")
+}
@@ -0,0 +1,114 @@
+package gormboxtest
+
+import (
+	"github.com/lyouthzzz/gobox/gormbox"
+	"gorm.io/gorm"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// UpdateGoldenEnv rewrites the golden files instead of comparing with them when set to 1,
+// e.g. GORMBOXTEST_UPDATE_GOLDEN=1 go test ./...
+const UpdateGoldenEnv = "GORMBOXTEST_UPDATE_GOLDEN"
+
+type Statement = gormbox.RecordEntry
+
+// Recorder keeps every statement executed by the db it records.
+type Recorder struct {
+	*gormbox.Recorder
+}
+
+// Record starts recording the statements of db and of every session and transaction sharing its callbacks.
+func Record(db *gorm.DB) *Recorder {
+	r := &Recorder{Recorder: gormbox.NewRecorder(0)}
+	gormbox.Intercept(db, r.Interceptor())
+	return r
+}
+
+func (r *Recorder) Statements() []Statement {
+	return r.Entries()
+}
+
+func (r *Recorder) SQL() []string {
+	statements := r.Statements()
+	sqls := make([]string, 0, len(statements))
+	for _, statement := range statements {
+		sqls = append(sqls, statement.SQL)
+	}
+	return sqls
+}
+
+// AssertSQL fails t unless the statements recorded are exactly sqls, in order.
+func (r *Recorder) AssertSQL(t testing.TB, sqls ...string) {
+	t.Helper()
+
+	got := r.SQL()
+	if len(got) != len(sqls) {
+		t.Fatalf("gormboxtest: %d statements recorded, want %d:\n%s", len(got), len(sqls), strings.Join(got, "\n"))
+	}
+	for i := range sqls {
+		if got[i] != sqls[i] {
+			t.Fatalf("gormboxtest: statement %d is\n%s\nwant\n%s", i, got[i], sqls[i])
+		}
+	}
+}
+
+// AssertCount fails t unless n statements were recorded.
+func (r *Recorder) AssertCount(t testing.TB, n int) {
+	t.Helper()
+
+	if got := r.SQL(); len(got) != n {
+		t.Fatalf("gormboxtest: %d statements recorded, want %d:\n%s", len(got), n, strings.Join(got, "\n"))
+	}
+}
+
+// AssertContains fails t unless a recorded statement contains substr.
+func (r *Recorder) AssertContains(t testing.TB, substr string) {
+	t.Helper()
+
+	got := r.SQL()
+	for _, sql := range got {
+		if strings.Contains(sql, substr) {
+			return
+		}
+	}
+	t.Fatalf("gormboxtest: no statement contains %q:\n%s", substr, strings.Join(got, "\n"))
+}
+
+// AssertNoErrors fails t when a recorded statement failed.
+func (r *Recorder) AssertNoErrors(t testing.TB) {
+	t.Helper()
+
+	for _, statement := range r.Statements() {
+		if statement.Err != nil {
+			t.Fatalf("gormboxtest: statement failed: %s\n%s", statement.Err, statement.SQL)
+		}
+	}
+}
+
+// AssertGolden fails t unless the snapshot of r equals the content of the golden file at path,
+// see UpdateGoldenEnv to write it.
+func AssertGolden(t testing.TB, r *gormbox.Recorder, path string) {
+	t.Helper()
+
+	got := r.Snapshot()
+	if os.Getenv(UpdateGoldenEnv) == "1" {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("gormboxtest: read golden file, %s=1 writes it: %s", UpdateGoldenEnv, err)
+	}
+	if got != string(want) {
+		t.Fatalf("gormboxtest: statements differ from %s, %s=1 rewrites it\ngot:\n%s\nwant:\n%s", path, UpdateGoldenEnv, got, want)
+	}
+}
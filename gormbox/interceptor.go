@@ -2,7 +2,6 @@ package gormbox
 
 import (
 	"context"
-	"github.com/prometheus/client_golang/prometheus"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
@@ -41,6 +40,7 @@ func InterceptorTracing(dsn *DSN) Interceptor {
 				return
 			}
 
+			parent := ctx
 			ctx, span := tracer.Start(ctx, operation)
 			defer span.End()
 
@@ -52,7 +52,10 @@ func InterceptorTracing(dsn *DSN) Interceptor {
 			span.SetAttributes(semconv.DBOperationKey.String(operation))
 			span.SetAttributes(attribute.Key("trace_id").String(trace.SpanContextFromContext(ctx).TraceID().String()))
 
+			// expose the span to the inner interceptors
+			db.Statement.Context = ctx
 			next(db)
+			db.Statement.Context = parent
 
 			if err := db.Statement.Error; err != nil {
 				span.RecordError(err)
@@ -106,40 +109,34 @@ func InterceptorLogging(dsn *DSN, logger *zap.Logger) Interceptor {
 			traceId := trace.SpanContextFromContext(ctx).TraceID().String()
 			spanId := trace.SpanContextFromContext(ctx).SpanID().String()
 
+			fields := []zap.Field{
+				zap.String("trace_id", traceId),
+				zap.String("span_id", spanId),
+			}
+			if fp, ok := db.InstanceGet(fingerprintSetting); ok {
+				fields = append(fields, zap.Any("fingerprint", fp))
+			}
+			// the plan follows in a "gormbox explain" entry
+			_, slow := db.InstanceGet(explainSetting)
+			if slow {
+				fields = append(fields, zap.String("slow_query", "true"))
+			}
+
 			if err := db.Statement.Error; err != nil {
-				logger.Error(message.String(),
-					zap.String("trace_id", traceId),
-					zap.String("span_id", spanId),
+				logger.Error(message.String(), append(fields,
 					zap.String("exception_msg", err.Error()),
 					zap.String("exception_type", "gorm"),
-				)
+				)...)
+			} else if slow {
+				logger.Warn(message.String(), fields...)
 			} else {
-				logger.Info(message.String(),
-					zap.String("trace_id", traceId),
-					zap.String("span_id", spanId),
-				)
+				logger.Info(message.String(), fields...)
 			}
 		}
 	}
 }
 
 func InterceptorMetrics(dsn *DSN) Interceptor {
-	requestsTotals := prometheus.NewCounterVec(prometheus.CounterOpts{
-		Namespace: "db",
-		Subsystem: "requests",
-		Name:      "totals",
-		Help:      "The total number of db operation",
-	}, []string{"db_instance", "db_name", "operation"})
-
-	requestLatency := prometheus.NewHistogramVec(prometheus.HistogramOpts{
-		Namespace:   "db",
-		Subsystem:   "requests",
-		Name:        "latency_seconds",
-		Help:        "The second latency of db operation",
-		ConstLabels: nil,
-	}, []string{"db_instance", "db_name", "operation"})
-	prometheus.MustRegister(requestsTotals, requestLatency)
-
 	return func(action string, next Handler) Handler {
 		return func(db *gorm.DB) {
 			var (
@@ -159,11 +156,11 @@ func InterceptorMetrics(dsn *DSN) Interceptor {
 			next(db)
 
 			if db.Statement.Error == nil {
-				requestsTotals.WithLabelValues(dsn.Addr, dsn.DbName, operation).Inc()
-				requestLatency.WithLabelValues(dsn.Addr, dsn.DbName, operation).Observe(time.Since(st).Seconds())
+				requestsTotals.WithLabelValues(dsn.Name, dsn.Addr, dsn.DbName, operation).Inc()
+				requestLatency.WithLabelValues(dsn.Name, dsn.Addr, dsn.DbName, operation).Observe(time.Since(st).Seconds())
 			} else {
-				requestsTotals.WithLabelValues(dsn.Addr, dsn.DbName, operation).Inc()
-				requestLatency.WithLabelValues(dsn.Addr, dsn.DbName, operation).Observe(time.Since(st).Seconds())
+				requestsTotals.WithLabelValues(dsn.Name, dsn.Addr, dsn.DbName, operation).Inc()
+				requestLatency.WithLabelValues(dsn.Name, dsn.Addr, dsn.DbName, operation).Observe(time.Since(st).Seconds())
 			}
 		}
 	}
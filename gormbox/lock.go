@@ -0,0 +1,305 @@
+package gormbox
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/semconv/v1.6.1"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"sync"
+	"time"
+)
+
+var (
+	ErrLockTimeout = errors.New("gormbox: lock wait timeout")
+	ErrLockLost    = errors.New("gormbox: lock lost")
+)
+
+const (
+	// lockPollInterval bounds each GET_LOCK wait, so that a cancelled context stops waiting soon
+	lockPollInterval = time.Second
+	lockQueryTimeout = 5 * time.Second
+)
+
+type LockOption func(*lockOptions)
+
+type lockOptions struct {
+	logger    *zap.Logger
+	timeout   time.Duration
+	keepAlive time.Duration
+}
+
+func LockOptionLogger(logger *zap.Logger) LockOption {
+	return func(o *lockOptions) { o.logger = logger }
+}
+
+// LockOptionTimeout bounds the wait for the lock, zero tries once without waiting.
+// By default only the context bounds it.
+func LockOptionTimeout(timeout time.Duration) LockOption {
+	return func(o *lockOptions) { o.timeout = timeout }
+}
+
+// LockOptionKeepAlive is how often the lock is checked to still be held, 30s by default.
+func LockOptionKeepAlive(interval time.Duration) LockOption {
+	return func(o *lockOptions) { o.keepAlive = interval }
+}
+
+// Lock is a mysql named lock, held by a connection of the pool pinned until Release.
+// Mysql releases the lock when that connection dies, Lost tells the holder.
+type Lock struct {
+	name      string
+	dsn       *DSN
+	operation string
+	options   *lockOptions
+	conn      *sql.Conn
+	acquired  time.Time
+
+	lost     chan struct{}
+	done     chan struct{}
+	wg       sync.WaitGroup
+	release  sync.Once
+	released error
+}
+
+// AcquireLock takes the mysql named lock name with GET_LOCK on a connection of db of its own, waiting for it
+// until ctx is done or the timeout of LockOptionTimeout, in which case it fails with ErrLockTimeout.
+// The lock is held until Release, it runs as operation OperationFrom(ctx), "lock" by default.
+func AcquireLock(ctx context.Context, db *gorm.DB, dsn *DSN, name string, opts ...LockOption) (*Lock, error) {
+	options := &lockOptions{logger: globalLogger, timeout: -1, keepAlive: 30 * time.Second}
+	for _, opt := range opts {
+		opt(options)
+	}
+	if dsn.Driver != DriverMysql {
+		return nil, fmt.Errorf("gormbox: lock %s on %s, advisory locks need mysql", name, dsn.Driver)
+	}
+
+	operation := OperationFrom(ctx)
+	if operation == "" {
+		operation = "lock"
+	}
+	ctx, span := otel.Tracer(dsn.Driver).Start(ctx, operation)
+	defer span.End()
+	span.SetAttributes(
+		semconv.DBSystemKey.String(dsn.Driver),
+		semconv.DBNameKey.String(dsn.DbName),
+		semconv.DBOperationKey.String(operation),
+		attribute.String("db.lock", name),
+	)
+
+	st := time.Now()
+	conn, err := getLock(ctx, db, name, options.timeout)
+	latency := time.Since(st)
+	requestsTotals.WithLabelValues(dsn.Name, dsn.Addr, dsn.DbName, operation).Inc()
+	requestLatency.WithLabelValues(dsn.Name, dsn.Addr, dsn.DbName, operation).Observe(latency.Seconds())
+
+	fields := []zap.Field{
+		zap.String("db.operation", operation),
+		zap.String("db.lock", name),
+		zap.Duration("latency", latency),
+		zap.String("trace_id", trace.SpanContextFromContext(ctx).TraceID().String()),
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		fields = append(fields, zap.String("exception_msg", err.Error()), zap.String("exception_type", "gorm"))
+		if errors.Is(err, ErrLockTimeout) {
+			lockTotals.WithLabelValues(dsn.Name, "timeout").Inc()
+			options.logger.Warn("gormbox lock", fields...)
+		} else {
+			lockTotals.WithLabelValues(dsn.Name, "error").Inc()
+			options.logger.Error("gormbox lock", fields...)
+		}
+		return nil, err
+	}
+	span.SetStatus(codes.Ok, "OK")
+	lockTotals.WithLabelValues(dsn.Name, "acquired").Inc()
+	options.logger.Info("gormbox lock", fields...)
+
+	l := &Lock{
+		name:      name,
+		dsn:       dsn,
+		operation: operation,
+		options:   options,
+		conn:      conn,
+		acquired:  time.Now(),
+		lost:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if options.keepAlive > 0 {
+		l.wg.Add(1)
+		go l.keepAlive()
+	}
+	return l, nil
+}
+
+// WithLock runs fn holding the lock name, see AcquireLock. The context of fn is cancelled when the lock is lost.
+func WithLock(ctx context.Context, db *gorm.DB, dsn *DSN, name string, fn func(ctx context.Context) error, opts ...LockOption) error {
+	l, err := AcquireLock(ctx, db, dsn, name, opts...)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-l.Lost():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	err = fn(ctx)
+	if releaseErr := l.Release(); err == nil {
+		err = releaseErr
+	}
+	return err
+}
+
+// getLock pins a connection of db holding the lock name.
+func getLock(ctx context.Context, db *gorm.DB, name string, timeout time.Duration) (*sql.Conn, error) {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var deadline time.Time
+	if timeout >= 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	for {
+		// GET_LOCK waits whole seconds, the last fraction of the timeout is slept before trying once more
+		wait := 0
+		if remaining := time.Until(deadline); deadline.IsZero() || remaining >= lockPollInterval {
+			wait = int(lockPollInterval / time.Second)
+		} else if remaining > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(remaining):
+			}
+		}
+		if err = ctx.Err(); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+
+		var got sql.NullInt64
+		if err = conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", name, wait).Scan(&got); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		if !got.Valid {
+			_ = conn.Close()
+			return nil, fmt.Errorf("gormbox: lock %s: GET_LOCK failed", name)
+		}
+		if got.Int64 == 1 {
+			return conn, nil
+		}
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			_ = conn.Close()
+			return nil, fmt.Errorf("%w: %s", ErrLockTimeout, name)
+		}
+	}
+}
+
+func (l *Lock) Name() string {
+	return l.name
+}
+
+// Lost is closed when the lock is found lost, e.g. its connection died.
+func (l *Lock) Lost() <-chan struct{} {
+	return l.lost
+}
+
+func (l *Lock) keepAlive() {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(l.options.keepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), lockQueryTimeout)
+		var held sql.NullInt64
+		err := l.conn.QueryRowContext(ctx, "SELECT IS_USED_LOCK(?) = CONNECTION_ID()", l.name).Scan(&held)
+		cancel()
+		if err == nil && held.Int64 == 1 {
+			continue
+		}
+		if err == nil {
+			err = errors.New("held by another connection")
+		}
+
+		close(l.lost)
+		lockTotals.WithLabelValues(l.dsn.Name, "lost").Inc()
+		l.options.logger.Error("gormbox lock lost",
+			zap.String("db.operation", l.operation),
+			zap.String("db.lock", l.name),
+			zap.Duration("held", time.Since(l.acquired)),
+			zap.String("exception_msg", err.Error()),
+			zap.String("exception_type", "gorm"),
+		)
+		return
+	}
+}
+
+// Release releases the lock and gives its connection back to the pool, it fails with ErrLockLost when
+// the lock was lost while held. Calling it again returns the same.
+func (l *Lock) Release() error {
+	l.release.Do(func() {
+		close(l.done)
+		l.wg.Wait()
+
+		select {
+		case <-l.lost:
+			l.released = fmt.Errorf("%w: %s", ErrLockLost, l.name)
+		default:
+			ctx, cancel := context.WithTimeout(context.Background(), lockQueryTimeout)
+			var released sql.NullInt64
+			err := l.conn.QueryRowContext(ctx, "SELECT RELEASE_LOCK(?)", l.name).Scan(&released)
+			cancel()
+			if err != nil {
+				l.released = err
+			} else if released.Int64 != 1 {
+				l.released = fmt.Errorf("%w: %s", ErrLockLost, l.name)
+			}
+		}
+
+		if l.released != nil {
+			// the connection may still hold the lock, closing it for good releases it
+			_ = l.conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+		}
+		_ = l.conn.Close()
+
+		fields := []zap.Field{
+			zap.String("db.operation", l.operation),
+			zap.String("db.lock", l.name),
+			zap.Duration("held", time.Since(l.acquired)),
+		}
+		if l.released != nil {
+			l.options.logger.Error("gormbox unlock", append(fields,
+				zap.String("exception_msg", l.released.Error()),
+				zap.String("exception_type", "gorm"),
+			)...)
+		} else {
+			l.options.logger.Info("gormbox unlock", fields...)
+		}
+	})
+	return l.released
+}
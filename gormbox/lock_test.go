@@ -0,0 +1,64 @@
+package gormbox
+
+import (
+	"context"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"testing"
+	"time"
+)
+
+func TestAcquireLock(t *testing.T) {
+	db, mock := mockDB(t)
+	dsn := &DSN{Driver: DriverMysql, Name: "test"}
+	ctx := context.Background()
+
+	mock.ExpectQuery(`SELECT GET_LOCK\(\?, \?\)`).WithArgs("jobs", 1).WillReturnRows(sqlmock.NewRows([]string{"got"}).AddRow(0))
+	mock.ExpectQuery(`SELECT GET_LOCK\(\?, \?\)`).WithArgs("jobs", 1).WillReturnRows(sqlmock.NewRows([]string{"got"}).AddRow(1))
+	l, err := AcquireLock(ctx, db, dsn, "jobs", LockOptionLogger(zap.NewNop()), LockOptionKeepAlive(0))
+	require.NoError(t, err)
+	require.Equal(t, "jobs", l.Name())
+
+	mock.ExpectQuery(`SELECT RELEASE_LOCK\(\?\)`).WithArgs("jobs").WillReturnRows(sqlmock.NewRows([]string{"released"}).AddRow(1))
+	require.NoError(t, l.Release())
+	require.NoError(t, l.Release())
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	mock.ExpectQuery(`SELECT GET_LOCK\(\?, \?\)`).WithArgs("jobs", 0).WillReturnRows(sqlmock.NewRows([]string{"got"}).AddRow(0))
+	_, err = AcquireLock(ctx, db, dsn, "jobs", LockOptionLogger(zap.NewNop()), LockOptionTimeout(0))
+	require.ErrorIs(t, err, ErrLockTimeout)
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	// cancelling stops the wait
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	mock.ExpectQuery(`SELECT GET_LOCK\(\?, \?\)`).WithArgs("jobs", 1).WillDelayFor(time.Minute).WillReturnRows(sqlmock.NewRows([]string{"got"}).AddRow(1))
+	st := time.Now()
+	_, err = AcquireLock(ctx, db, dsn, "jobs", LockOptionLogger(zap.NewNop()))
+	require.Error(t, err)
+	require.Less(t, time.Since(st), time.Second)
+
+	_, err = AcquireLock(context.Background(), db, &DSN{Driver: DriverClickhouse}, "jobs")
+	require.EqualError(t, err, "gormbox: lock jobs on clickhouse, advisory locks need mysql")
+}
+
+func TestWithLock_Lost(t *testing.T) {
+	db, mock := mockDB(t)
+	dsn := &DSN{Driver: DriverMysql, Name: "test"}
+
+	mock.ExpectQuery(`SELECT GET_LOCK\(\?, \?\)`).WithArgs("jobs", 1).WillReturnRows(sqlmock.NewRows([]string{"got"}).AddRow(1))
+	mock.ExpectQuery(`SELECT IS_USED_LOCK\(\?\) = CONNECTION_ID\(\)`).WithArgs("jobs").WillReturnRows(sqlmock.NewRows([]string{"held"}).AddRow(1))
+	mock.ExpectQuery(`SELECT IS_USED_LOCK\(\?\) = CONNECTION_ID\(\)`).WithArgs("jobs").WillReturnRows(sqlmock.NewRows([]string{"held"}).AddRow(nil))
+
+	err := WithLock(context.Background(), db, dsn, "jobs", func(ctx context.Context) error {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Second):
+			return context.DeadlineExceeded
+		}
+	}, LockOptionLogger(zap.NewNop()), LockOptionKeepAlive(10*time.Millisecond))
+	require.ErrorIs(t, err, ErrLockLost)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,154 @@
+package gormbox
+
+import (
+	"context"
+	"fmt"
+	"gorm.io/gorm"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Manager builds and owns the named dbs of a service, every db is a reloadable Handle.
+type Manager struct {
+	mu      sync.RWMutex
+	handles map[string]*Handle
+	opts    []Option
+}
+
+type HealthError struct {
+	Errs map[string]error
+}
+
+func (e *HealthError) Error() string {
+	names := make([]string, 0, len(e.Errs))
+	for name := range e.Errs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	messages := make([]string, 0, len(names))
+	for _, name := range names {
+		messages = append(messages, name+": "+e.Errs[name].Error())
+	}
+	return "gormbox: unhealthy db " + strings.Join(messages, "; ")
+}
+
+// NewManager builds every config with the shared opts, the name becomes the logical name of the db.
+// Nothing is left open when one of them fails to build.
+func NewManager(configs map[string]*Config, opts ...Option) (*Manager, error) {
+	m := &Manager{handles: make(map[string]*Handle, len(configs)), opts: opts}
+	for name, config := range configs {
+		h, err := NewHandle(config, m.options(name)...)
+		if err != nil {
+			_ = m.Close()
+			return nil, fmt.Errorf("gormbox: build db %s: %w", name, err)
+		}
+		m.handles[name] = h
+	}
+	return m, nil
+}
+
+func (m *Manager) Get(name string) (*gorm.DB, error) {
+	h, err := m.Handle(name)
+	if err != nil {
+		return nil, err
+	}
+	return h.DB(), nil
+}
+
+func (m *Manager) MustGet(name string) *gorm.DB {
+	db, err := m.Get(name)
+	if err != nil {
+		panic(err)
+	}
+	return db
+}
+
+func (m *Manager) Handle(name string) (*Handle, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	h, ok := m.handles[name]
+	if !ok {
+		return nil, fmt.Errorf("gormbox: unknown db %s", name)
+	}
+	return h, nil
+}
+
+func (m *Manager) Reload(name string, config *Config) error {
+	h, err := m.Handle(name)
+	if err != nil {
+		return err
+	}
+	return h.Reload(config)
+}
+
+func (m *Manager) Names() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	names := make([]string, 0, len(m.handles))
+	for name := range m.handles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Ping checks every db concurrently, the returned *HealthError carries the failure of each unhealthy db.
+func (m *Manager) Ping(ctx context.Context) error {
+	m.mu.RLock()
+	handles := make(map[string]*Handle, len(m.handles))
+	for name, h := range m.handles {
+		handles[name] = h
+	}
+	m.mu.RUnlock()
+
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		errs = make(map[string]error)
+	)
+	for name, h := range handles {
+		wg.Add(1)
+		go func(name string, h *Handle) {
+			defer wg.Done()
+
+			sqlDB, err := h.DB().DB()
+			if err == nil {
+				err = sqlDB.PingContext(ctx)
+			}
+			if err != nil {
+				mu.Lock()
+				errs[name] = err
+				mu.Unlock()
+			}
+		}(name, h)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return &HealthError{Errs: errs}
+	}
+	return nil
+}
+
+// Close closes every db and returns the first error.
+func (m *Manager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var err error
+	for name, h := range m.handles {
+		if closeErr := h.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("gormbox: close db %s: %w", name, closeErr)
+		}
+		delete(m.handles, name)
+	}
+	return err
+}
+
+func (m *Manager) options(name string) []Option {
+	return append(append([]Option(nil), m.opts...), OptionName(name))
+}
@@ -0,0 +1,96 @@
+package gormbox
+
+import (
+	"context"
+	"errors"
+	"github.com/glebarez/sqlite"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+	"testing"
+)
+
+const driverSqlite = "sqlite"
+
+func init() {
+	RegisterParser(driverSqlite, &sqliteParser{})
+}
+
+type sqliteParser struct{}
+
+func (parser *sqliteParser) GetDialector(dsn string) gorm.Dialector {
+	return sqlite.Open(dsn)
+}
+
+func (parser *sqliteParser) ParseDSN(dsn string) (*DSN, error) {
+	return &DSN{Driver: driverSqlite, Net: "file", Addr: dsn, DbName: "main"}, nil
+}
+
+func (parser *sqliteParser) FormatDSN(dsn *DSN) (string, error) {
+	return dsn.Addr, nil
+}
+
+func TestManager(t *testing.T) {
+	configs := make(map[string]*Config)
+	for _, name := range []string{"order", "user"} {
+		config := DefaultConfig().WithDriver(driverSqlite).WithDSN(":memory:")
+		// every connection would open its own in-memory database
+		config.MaxOpenConns = 1
+		configs[name] = config
+	}
+	m, err := NewManager(configs)
+	require.NoError(t, err)
+	require.Equal(t, []string{"order", "user"}, m.Names())
+
+	order, err := m.Get("order")
+	require.NoError(t, err)
+	user, err := m.Get("user")
+	require.NoError(t, err)
+	require.NotSame(t, order, user)
+
+	// the name is the logical name of the metrics
+	ctx := WithOperation(context.Background(), "manager.ping")
+	before := testutil.ToFloat64(requestsTotals.WithLabelValues("order", ":memory:", "main", "manager.ping"))
+	require.NoError(t, order.WithContext(ctx).Exec("SELECT 1").Error)
+	require.Equal(t, before+1, testutil.ToFloat64(requestsTotals.WithLabelValues("order", ":memory:", "main", "manager.ping")))
+	require.Zero(t, testutil.ToFloat64(requestsTotals.WithLabelValues("user", ":memory:", "main", "manager.ping")))
+
+	require.NoError(t, m.Ping(context.Background()))
+	sqlDB, err := user.DB()
+	require.NoError(t, err)
+	require.NoError(t, sqlDB.Close())
+	var healthErr *HealthError
+	require.ErrorAs(t, m.Ping(context.Background()), &healthErr)
+	require.Len(t, healthErr.Errs, 1)
+	require.EqualError(t, healthErr.Errs["user"], "sql: database is closed")
+
+	sqlDB, err = order.DB()
+	require.NoError(t, err)
+	require.NoError(t, m.Close())
+	require.Empty(t, m.Names())
+	_, err = m.Get("order")
+	require.EqualError(t, err, "gormbox: unknown db order")
+	require.EqualError(t, sqlDB.Ping(), "sql: database is closed")
+}
+
+func TestManager_Empty(t *testing.T) {
+	m, err := NewManager(nil)
+	require.NoError(t, err)
+
+	_, err = m.Get("order")
+	require.EqualError(t, err, "gormbox: unknown db order")
+	require.NoError(t, m.Ping(context.Background()))
+	require.NoError(t, m.Close())
+}
+
+func TestManager_BuildError(t *testing.T) {
+	_, err := NewManager(map[string]*Config{"order": DefaultConfig().WithDriver("oracle")})
+	var configErr *ConfigError
+	require.ErrorAs(t, err, &configErr)
+	require.Equal(t, "driver", configErr.Field)
+}
+
+func TestHealthError(t *testing.T) {
+	err := &HealthError{Errs: map[string]error{"user": errors.New("timeout"), "order": errors.New("refused")}}
+	require.EqualError(t, err, "gormbox: unhealthy db order: refused; user: timeout")
+}
@@ -0,0 +1,137 @@
+package gormbox
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// collectors are shared by every built db, so that building more than one db doesn't register twice
+var (
+	requestsTotals = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "db",
+		Subsystem: "requests",
+		Name:      "totals",
+		Help:      "The total number of db operation",
+	}, []string{"db_logical_name", "db_instance", "db_name", "operation"})
+
+	requestLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:   "db",
+		Subsystem:   "requests",
+		Name:        "latency_seconds",
+		Help:        "The second latency of db operation",
+		ConstLabels: nil,
+	}, []string{"db_logical_name", "db_instance", "db_name", "operation"})
+
+	fingerprintTotals = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "db",
+		Subsystem: "fingerprint",
+		Name:      "totals",
+		Help:      "The total number of db statement by fingerprint",
+	}, []string{"db_logical_name", "db_instance", "db_name", "fingerprint"})
+
+	fingerprintLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "db",
+		Subsystem: "fingerprint",
+		Name:      "latency_seconds",
+		Help:      "The second latency of db statement by fingerprint",
+	}, []string{"db_logical_name", "db_instance", "db_name", "fingerprint"})
+
+	cacheTotals = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "db",
+		Subsystem: "cache",
+		Name:      "totals",
+		Help:      "The total number of db query cache lookup",
+	}, []string{"db_logical_name", "db_instance", "db_name", "operation", "result"})
+
+	shardingTotals = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "db",
+		Subsystem: "sharding",
+		Name:      "totals",
+		Help:      "The total number of db statement by shard",
+	}, []string{"db_logical_name", "table", "shard_db", "shard_table"})
+
+	outboxTotals = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "db",
+		Subsystem: "outbox",
+		Name:      "totals",
+		Help:      "The total number of outbox event dispatch",
+	}, []string{"db_logical_name", "topic", "result"})
+
+	outboxLag = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "db",
+		Subsystem: "outbox",
+		Name:      "lag_seconds",
+		Help:      "The second lag between storing and publishing an outbox event",
+	}, []string{"db_logical_name", "topic"})
+
+	lockConflictTotals = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "db",
+		Subsystem: "optimistic_lock",
+		Name:      "conflict_totals",
+		Help:      "The total number of db update failed on a stale version",
+	}, []string{"db_logical_name", "table"})
+
+	lockTotals = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "db",
+		Subsystem: "lock",
+		Name:      "totals",
+		Help:      "The total number of db advisory lock by result",
+	}, []string{"db_logical_name", "result"})
+
+	budgetExceededTotals = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "db",
+		Subsystem: "budget",
+		Name:      "exceeded_totals",
+		Help:      "The total number of db query budget exceeded",
+	}, []string{"db_logical_name", "operation", "policy"})
+
+	cdcTotals = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "db",
+		Subsystem: "cdc",
+		Name:      "totals",
+		Help:      "The total number of cdc event handling",
+	}, []string{"db_logical_name", "table", "action", "result"})
+
+	cdcLag = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "db",
+		Subsystem: "cdc",
+		Name:      "lag_seconds",
+		Help:      "The second lag between a change on the source and its cdc event handled",
+	}, []string{"db_logical_name", "table"})
+
+	retentionTotals = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "db",
+		Subsystem: "retention",
+		Name:      "totals",
+		Help:      "The total number of db row purged by retention",
+	}, []string{"db_logical_name", "table", "action"})
+
+	retentionLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "db",
+		Subsystem: "retention",
+		Name:      "latency_seconds",
+		Help:      "The second latency of db retention batch",
+	}, []string{"db_logical_name", "table"})
+
+	replicaTotals = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "db",
+		Subsystem: "replica",
+		Name:      "totals",
+		Help:      "The total number of db read by target",
+	}, []string{"db_logical_name", "target"})
+
+	replicaLag = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "db",
+		Subsystem: "replica",
+		Name:      "lag_seconds",
+		Help:      "The second lag of db replica behind its primary",
+	}, []string{"db_logical_name", "replica"})
+
+	reloadTotals = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "db",
+		Subsystem: "reload",
+		Name:      "totals",
+		Help:      "The total number of db config reload",
+	}, []string{"db_logical_name", "db_instance", "db_name", "result"})
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotals, requestLatency, fingerprintTotals, fingerprintLatency, cacheTotals, shardingTotals, outboxTotals, outboxLag, lockConflictTotals, lockTotals, budgetExceededTotals, cdcTotals, cdcLag, retentionTotals, retentionLatency, replicaTotals, replicaLag, reloadTotals)
+}
@@ -0,0 +1,493 @@
+package gormbox
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	clickhousego "github.com/ClickHouse/clickhouse-go/v2"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMigrationChecksum     = errors.New("gormbox: applied migration changed")
+	ErrMigrationMissing      = errors.New("gormbox: applied migration missing")
+	ErrMigrationIrreversible = errors.New("gormbox: migration has no down")
+	ErrMigrationLocked       = errors.New("gormbox: migration lock held by another migrator")
+)
+
+// <version>_<name>.up.sql and <version>_<name>.down.sql
+var migrationFile = regexp.MustCompile(`^(\d+)_([\w-]+)\.(up|down)\.sql$`)
+
+type Migration struct {
+	Version  uint64
+	Name     string
+	Up       string
+	Down     string
+	Checksum string
+}
+
+// MigrationRecord is a row of the history table, one per applied migration.
+type MigrationRecord struct {
+	Version   uint64 `gorm:"primaryKey;autoIncrement:false"`
+	Name      string `gorm:"size:191"`
+	Checksum  string `gorm:"size:64"`
+	AppliedAt time.Time
+}
+
+type MigrationStatus struct {
+	*Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+type MigrateOption func(*migrateOptions)
+
+type migrateOptions struct {
+	table       string
+	logger      *zap.Logger
+	dryRun      bool
+	lockTimeout time.Duration
+}
+
+// MigrateOptionTable names the history table, the lock table of the drivers without advisory locks is "<table>_lock".
+func MigrateOptionTable(table string) MigrateOption {
+	return func(o *migrateOptions) { o.table = table }
+}
+
+func MigrateOptionLogger(logger *zap.Logger) MigrateOption {
+	return func(o *migrateOptions) { o.logger = logger }
+}
+
+// MigrateOptionDryRun logs the statements instead of executing them, the history is left as is.
+func MigrateOptionDryRun(dryRun bool) MigrateOption {
+	return func(o *migrateOptions) { o.dryRun = dryRun }
+}
+
+// MigrateOptionLockTimeout is how long a migrator waits for the one holding the lock.
+func MigrateOptionLockTimeout(timeout time.Duration) MigrateOption {
+	return func(o *migrateOptions) { o.lockTimeout = timeout }
+}
+
+// Migrator applies the versioned sql files of a fs.FS. Every statement goes through the gorm callbacks,
+// so migrations are traced, logged and counted as operation "migrate.<version>.<up|down>".
+type Migrator struct {
+	db         *gorm.DB
+	migrations []*Migration
+	options    *migrateOptions
+}
+
+// NewMigrator reads the migrations of fsys, its root holds the files named <version>_<name>.up.sql
+// and, optionally, <version>_<name>.down.sql.
+func NewMigrator(db *gorm.DB, fsys fs.FS, opts ...MigrateOption) (*Migrator, error) {
+	options := &migrateOptions{table: "gormbox_migrations", logger: globalLogger, lockTimeout: time.Minute}
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[uint64]*Migration)
+	for _, entry := range entries {
+		m := migrationFile.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || m == nil {
+			continue
+		}
+		version, err := strconv.ParseUint(m[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("gormbox: migration %s: %w", entry.Name(), err)
+		}
+		data, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = migration
+		}
+		if migration.Name != m[2] {
+			return nil, fmt.Errorf("gormbox: migration version %d named both %s and %s", version, migration.Name, m[2])
+		}
+		if m[3] == "up" {
+			migration.Up = string(data)
+			sum := sha256.Sum256(data)
+			migration.Checksum = hex.EncodeToString(sum[:])
+		} else {
+			migration.Down = string(data)
+		}
+	}
+
+	migrations := make([]*Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Checksum == "" {
+			return nil, fmt.Errorf("gormbox: migration %d_%s has no up", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return &Migrator{db: db, migrations: migrations, options: options}, nil
+}
+
+func (m *Migrator) Migrations() []*Migration {
+	return m.migrations
+}
+
+// Status lists every migration with whether it is applied.
+func (m *Migrator) Status(ctx context.Context) ([]*MigrationStatus, error) {
+	records, err := m.history(ctx)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]*MigrationStatus, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		status := &MigrationStatus{Migration: migration}
+		if record, ok := records[migration.Version]; ok {
+			status.Applied, status.AppliedAt = true, record.AppliedAt
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// Verify fails with ErrMigrationChecksum when an applied migration was edited since,
+// and with ErrMigrationMissing when it was removed.
+func (m *Migrator) Verify(ctx context.Context) error {
+	records, err := m.history(ctx)
+	if err != nil {
+		return err
+	}
+	return m.verify(records)
+}
+
+// Up applies the pending migrations in version order and returns them.
+func (m *Migrator) Up(ctx context.Context) ([]*Migration, error) {
+	return m.UpTo(ctx, 0)
+}
+
+// UpTo applies the pending migrations up to version included, zero means all of them.
+func (m *Migrator) UpTo(ctx context.Context, version uint64) ([]*Migration, error) {
+	var applied []*Migration
+	err := m.locked(ctx, func(records map[uint64]*MigrationRecord) error {
+		for _, migration := range m.migrations {
+			if version > 0 && migration.Version > version {
+				break
+			}
+			if _, ok := records[migration.Version]; ok {
+				continue
+			}
+			if err := m.apply(ctx, migration, true); err != nil {
+				return err
+			}
+			applied = append(applied, migration)
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// Down reverts the last steps applied migrations, newest first, and returns them.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]*Migration, error) {
+	var reverted []*Migration
+	err := m.locked(ctx, func(records map[uint64]*MigrationRecord) error {
+		for i := len(m.migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+			migration := m.migrations[i]
+			if _, ok := records[migration.Version]; !ok {
+				continue
+			}
+			if strings.TrimSpace(migration.Down) == "" {
+				return fmt.Errorf("%w: %d_%s", ErrMigrationIrreversible, migration.Version, migration.Name)
+			}
+			if err := m.apply(ctx, migration, false); err != nil {
+				return err
+			}
+			reverted = append(reverted, migration)
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// locked runs fn holding the migration lock with the verified history.
+func (m *Migrator) locked(ctx context.Context, fn func(records map[uint64]*MigrationRecord) error) error {
+	// a dry run neither creates the tables nor waits for the lock
+	if !m.options.dryRun {
+		// the history is shared by the tenants
+		db := m.db.WithContext(WithoutTenant(ctx))
+		if err := db.Table(m.options.table).AutoMigrate(&MigrationRecord{}); err != nil {
+			return err
+		}
+
+		lock, ok := migrationLocks[db.Dialector.Name()]
+		if !ok {
+			lock = migrationLockTable
+		}
+		unlock, err := lock(ctx, db, m.options.table, m.options.lockTimeout)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	records, err := m.history(ctx)
+	if err != nil {
+		return err
+	}
+	if err = m.verify(records); err != nil {
+		return err
+	}
+	return fn(records)
+}
+
+func (m *Migrator) history(ctx context.Context) (map[uint64]*MigrationRecord, error) {
+	db := m.db.WithContext(WithoutTenant(ctx))
+	records := make(map[uint64]*MigrationRecord)
+	if !db.Migrator().HasTable(m.options.table) {
+		return records, nil
+	}
+	var rows []*MigrationRecord
+	if err := db.Table(m.options.table).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		records[row.Version] = row
+	}
+	return records, nil
+}
+
+func (m *Migrator) verify(records map[uint64]*MigrationRecord) error {
+	migrations := make(map[uint64]*Migration, len(m.migrations))
+	for _, migration := range m.migrations {
+		migrations[migration.Version] = migration
+	}
+	for version, record := range records {
+		migration, ok := migrations[version]
+		if !ok {
+			return fmt.Errorf("%w: %d_%s", ErrMigrationMissing, version, record.Name)
+		}
+		if migration.Checksum != record.Checksum {
+			return fmt.Errorf("%w: %d_%s", ErrMigrationChecksum, version, record.Name)
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) apply(ctx context.Context, migration *Migration, up bool) error {
+	direction, script := "up", migration.Up
+	if !up {
+		direction, script = "down", migration.Down
+	}
+	fields := []zap.Field{
+		zap.Uint64("migration.version", migration.Version),
+		zap.String("migration.name", migration.Name),
+		zap.String("migration.direction", direction),
+	}
+	statements := splitSQL(script)
+
+	if m.options.dryRun {
+		for _, statement := range statements {
+			m.options.logger.Info("gormbox migrate dry run", append(fields, zap.String("db.statement", statement))...)
+		}
+		return nil
+	}
+
+	st := time.Now()
+	ctx = WithOperation(ctx, "migrate."+strconv.FormatUint(migration.Version, 10)+"."+direction)
+	db := m.db.WithContext(WithoutTenant(ctx))
+	// mysql commits ddl right away, the transaction only covers the dml and the history record there
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for _, statement := range statements {
+			if err := tx.Exec(statement).Error; err != nil {
+				return err
+			}
+		}
+		if up {
+			return tx.Table(m.options.table).Create(&MigrationRecord{
+				Version:   migration.Version,
+				Name:      migration.Name,
+				Checksum:  migration.Checksum,
+				AppliedAt: time.Now(),
+			}).Error
+		}
+		return tx.Table(m.options.table).Delete(&MigrationRecord{}, migration.Version).Error
+	})
+	if err != nil {
+		m.options.logger.Error("gormbox migrate error", append(fields,
+			zap.String("exception_msg", err.Error()),
+			zap.String("exception_type", "gorm"),
+		)...)
+		return fmt.Errorf("gormbox: migration %d_%s %s: %w", migration.Version, migration.Name, direction, err)
+	}
+	m.options.logger.Info("gormbox migrate", append(fields, zap.Duration("latency", time.Since(st)))...)
+	return nil
+}
+
+type migrationLock func(ctx context.Context, db *gorm.DB, table string, timeout time.Duration) (func(), error)
+
+var migrationLocks = map[string]migrationLock{
+	DriverMysql:      migrationLockMysql,
+	DriverClickhouse: migrationLockClickhouse,
+}
+
+// clickhouse error code of a CREATE TABLE on an existing table
+const clickhouseTableExists = 57
+
+// migrationLockMysql takes a named lock, mysql releases it when the holding connection dies.
+func migrationLockMysql(ctx context.Context, db *gorm.DB, table string, timeout time.Duration) (func(), error) {
+	name := "gormbox:" + table
+	conn, err := getLock(ctx, db, name, timeout)
+	if errors.Is(err, ErrLockTimeout) {
+		return nil, ErrMigrationLocked
+	}
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		_, _ = conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", name)
+		_ = conn.Close()
+	}, nil
+}
+
+type migrationLockRow struct {
+	ID       int `gorm:"primaryKey;autoIncrement:false"`
+	LockedAt time.Time
+}
+
+// migrationLockTable holds the lock as the single row of "<table>_lock", a migrator dying while holding it
+// leaves the row behind, it has to be deleted by hand.
+func migrationLockTable(ctx context.Context, db *gorm.DB, table string, timeout time.Duration) (func(), error) {
+	table += "_lock"
+	if err := db.Table(table).AutoMigrate(&migrationLockRow{}); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		result := db.Table(table).Clauses(clause.OnConflict{DoNothing: true}).Create(&migrationLockRow{ID: 1, LockedAt: time.Now()})
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		if result.RowsAffected == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			return nil, ErrMigrationLocked
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return func() {
+		db.WithContext(WithoutTenant(context.Background())).Table(table).Delete(&migrationLockRow{}, 1)
+	}, nil
+}
+
+// migrationLockClickhouse holds the lock as the "<table>_lock" table itself, clickhouse has neither unique keys
+// nor conditional inserts but creating a table that exists fails. The Memory engine drops the lock on restart,
+// a migrator dying while holding it leaves the table behind, it has to be dropped by hand.
+func migrationLockClickhouse(ctx context.Context, db *gorm.DB, table string, timeout time.Duration) (func(), error) {
+	table += "_lock"
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err := db.Exec("CREATE TABLE ? (locked_at DateTime) ENGINE = Memory", clause.Table{Name: table}).Error
+		if err == nil {
+			break
+		}
+		var exception *clickhousego.Exception
+		if !errors.As(err, &exception) || exception.Code != clickhouseTableExists {
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			return nil, ErrMigrationLocked
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return func() {
+		db.WithContext(WithoutTenant(context.Background())).Exec("DROP TABLE ?", clause.Table{Name: table})
+	}, nil
+}
+
+// splitSQL splits script on the semicolons outside of quotes and comments. A # starts a comment only where
+// a token may start, executable comments such as /*! ... */ and optimizer hints /*+ ... */ are kept.
+func splitSQL(script string) []string {
+	var (
+		statements []string
+		current    strings.Builder
+		quote      byte
+	)
+	flush := func() {
+		if statement := strings.TrimSpace(current.String()); statement != "" {
+			statements = append(statements, statement)
+		}
+		current.Reset()
+	}
+
+	for i := 0; i < len(script); i++ {
+		c := script[i]
+		switch {
+		case quote != 0:
+			current.WriteByte(c)
+			if c == '\\' && quote != '`' && i+1 < len(script) {
+				i++
+				current.WriteByte(script[i])
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+			current.WriteByte(c)
+		case c == '-' && strings.HasPrefix(script[i:], "--"), c == '#' && (i == 0 || !sqlIdentByte(script[i-1])):
+			for i < len(script) && script[i] != '\n' {
+				i++
+			}
+			current.WriteByte('\n')
+		case c == '/' && (strings.HasPrefix(script[i:], "/*!") || strings.HasPrefix(script[i:], "/*+")):
+			end := strings.Index(script[i+3:], "*/")
+			if end < 0 {
+				current.WriteString(script[i:])
+				i = len(script)
+			} else {
+				current.WriteString(script[i : i+end+5])
+				i += end + 4
+			}
+		case c == '/' && strings.HasPrefix(script[i:], "/*"):
+			end := strings.Index(script[i+2:], "*/")
+			if end < 0 {
+				i = len(script)
+			} else {
+				i += end + 3
+			}
+			current.WriteByte(' ')
+		case c == ';':
+			flush()
+		default:
+			current.WriteByte(c)
+		}
+	}
+	flush()
+	return statements
+}
+
+// sqlIdentByte reports whether c may be part of an unquoted identifier.
+func sqlIdentByte(c byte) bool {
+	return c == '_' || c == '$' || c == '#' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
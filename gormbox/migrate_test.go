@@ -0,0 +1,142 @@
+package gormbox
+
+import (
+	"context"
+	clickhousego "github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"gorm.io/driver/clickhouse"
+	"gorm.io/gorm"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestMigrator(t *testing.T) {
+	db := sqliteDB(t)
+	ctx := context.Background()
+	fsys := fstest.MapFS{
+		"1_users.up.sql":     {Data: []byte("CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT); -- users\nINSERT INTO users (name) VALUES ('a;b');")},
+		"1_users.down.sql":   {Data: []byte("DROP TABLE users;")},
+		"2_orders.up.sql":    {Data: []byte("/* orders */ CREATE TABLE orders (id INTEGER PRIMARY KEY, user_id INTEGER);")},
+		"2_orders.down.sql":  {Data: []byte("DROP TABLE orders;")},
+		"10_user_age.up.sql": {Data: []byte("ALTER TABLE users ADD COLUMN age INTEGER;")},
+		"README.md":          {Data: []byte("not a migration")},
+	}
+
+	core, logs := observer.New(zap.InfoLevel)
+	dryRun, err := NewMigrator(db, fsys, MigrateOptionDryRun(true), MigrateOptionLogger(zap.New(core)))
+	require.NoError(t, err)
+	planned, err := dryRun.Up(ctx)
+	require.NoError(t, err)
+	require.Len(t, planned, 3)
+	require.Equal(t, 4, logs.FilterMessage("gormbox migrate dry run").Len())
+	require.False(t, db.Migrator().HasTable("users"))
+	require.False(t, db.Migrator().HasTable("gormbox_migrations"))
+
+	m, err := NewMigrator(db, fsys, MigrateOptionLogger(zap.NewNop()))
+	require.NoError(t, err)
+	applied, err := m.UpTo(ctx, 2)
+	require.NoError(t, err)
+	require.Len(t, applied, 2)
+	var name string
+	require.NoError(t, db.Raw("SELECT name FROM users").Scan(&name).Error)
+	require.Equal(t, "a;b", name)
+
+	applied, err = m.Up(ctx)
+	require.NoError(t, err)
+	require.Len(t, applied, 1)
+	require.Equal(t, uint64(10), applied[0].Version)
+	var locks int64
+	require.NoError(t, db.Table("gormbox_migrations_lock").Count(&locks).Error)
+	require.Zero(t, locks)
+
+	statuses, err := m.Status(ctx)
+	require.NoError(t, err)
+	for _, status := range statuses {
+		require.True(t, status.Applied)
+	}
+
+	_, err = m.Down(ctx, 1)
+	require.ErrorIs(t, err, ErrMigrationIrreversible)
+
+	edited := fstest.MapFS{}
+	for name, file := range fsys {
+		edited[name] = file
+	}
+	edited["2_orders.up.sql"] = &fstest.MapFile{Data: []byte("CREATE TABLE orders (id INTEGER PRIMARY KEY);")}
+	m, err = NewMigrator(db, edited)
+	require.NoError(t, err)
+	require.ErrorIs(t, m.Verify(ctx), ErrMigrationChecksum)
+	_, err = m.Up(ctx)
+	require.ErrorIs(t, err, ErrMigrationChecksum)
+
+	delete(edited, "10_user_age.up.sql")
+	edited["2_orders.up.sql"] = fsys["2_orders.up.sql"]
+	m, err = NewMigrator(db, edited)
+	require.NoError(t, err)
+	require.ErrorIs(t, m.Verify(ctx), ErrMigrationMissing)
+}
+
+func TestMigrator_Down(t *testing.T) {
+	db := sqliteDB(t)
+	ctx := context.Background()
+	fsys := fstest.MapFS{
+		"1_users.up.sql":   {Data: []byte("CREATE TABLE users (id INTEGER PRIMARY KEY);")},
+		"1_users.down.sql": {Data: []byte("DROP TABLE users;")},
+	}
+	m, err := NewMigrator(db, fsys, MigrateOptionLogger(zap.NewNop()))
+	require.NoError(t, err)
+	_, err = m.Up(ctx)
+	require.NoError(t, err)
+
+	reverted, err := m.Down(ctx, 5)
+	require.NoError(t, err)
+	require.Len(t, reverted, 1)
+	require.False(t, db.Migrator().HasTable("users"))
+
+	// a lock left behind by another migrator
+	require.NoError(t, db.Table("gormbox_migrations_lock").Create(&migrationLockRow{ID: 1, LockedAt: time.Now()}).Error)
+	m, err = NewMigrator(db, fsys, MigrateOptionLogger(zap.NewNop()), MigrateOptionLockTimeout(50*time.Millisecond))
+	require.NoError(t, err)
+	_, err = m.Up(ctx)
+	require.ErrorIs(t, err, ErrMigrationLocked)
+}
+
+func TestMigrationLockClickhouse(t *testing.T) {
+	conn, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	db, err := gorm.Open(clickhouse.New(clickhouse.Config{Conn: conn, SkipInitializeWithVersion: true}),
+		&gorm.Config{DisableAutomaticPing: true, SkipDefaultTransaction: true})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	mock.ExpectExec("CREATE TABLE `gormbox_migrations_lock` \\(locked_at DateTime\\) ENGINE = Memory").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	unlock, err := migrationLockClickhouse(ctx, db, "gormbox_migrations", 0)
+	require.NoError(t, err)
+
+	mock.ExpectExec("CREATE TABLE `gormbox_migrations_lock`").WillReturnError(&clickhousego.Exception{Code: clickhouseTableExists})
+	_, err = migrationLockClickhouse(ctx, db, "gormbox_migrations", 0)
+	require.ErrorIs(t, err, ErrMigrationLocked)
+
+	mock.ExpectExec("DROP TABLE `gormbox_migrations_lock`").WillReturnResult(sqlmock.NewResult(0, 0))
+	unlock()
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSplitSQL(t *testing.T) {
+	require.Equal(t, []string{
+		"INSERT INTO t VALUES ('x;y', \"a\\\";\")",
+		"SELECT `a;b` FROM t",
+		"SELECT 1",
+	}, splitSQL("INSERT INTO t VALUES ('x;y', \"a\\\";\");\n# comment; here\nSELECT `a;b` FROM t; /* ; */ SELECT 1;\n"))
+	require.Equal(t, []string{
+		"/*!40101 SET NAMES utf8mb4 */",
+		"CREATE TABLE tmp#1 (id INT)",
+		"SELECT /*+ MAX_EXECUTION_TIME(1000) */ id FROM tmp#1",
+	}, splitSQL("/*!40101 SET NAMES utf8mb4 */;\nCREATE TABLE tmp#1 (id INT); #comment\nSELECT /*+ MAX_EXECUTION_TIME(1000) */ id FROM tmp#1;"))
+}
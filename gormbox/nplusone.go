@@ -0,0 +1,152 @@
+package gormbox
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const nPlusOneMaxCallers = 5
+
+var gormboxSourceDir string
+
+func init() {
+	_, file, _, _ := runtime.Caller(0)
+	gormboxSourceDir = filepath.Dir(file) + string(filepath.Separator)
+}
+
+type queryScopeKey struct{}
+
+type queryScope struct {
+	mu     sync.Mutex
+	stats  map[string]*queryScopeStat
+	warned map[string]bool
+}
+
+type queryScopeStat struct {
+	count      int
+	operations []string
+	callers    []string
+}
+
+// WithQueryScope marks ctx as one unit of work, e.g. a request, inside which repeated statements are detected.
+func WithQueryScope(ctx context.Context) context.Context {
+	return context.WithValue(ctx, queryScopeKey{}, &queryScope{stats: map[string]*queryScopeStat{}, warned: map[string]bool{}})
+}
+
+func queryScopeFrom(ctx context.Context) *queryScope {
+	scope, _ := ctx.Value(queryScopeKey{}).(*queryScope)
+	return scope
+}
+
+// record counts the statement and returns a snapshot of its stat the first time it repeats more than threshold times.
+func (scope *queryScope) record(fp, operation, caller string, threshold int) *queryScopeStat {
+	scope.mu.Lock()
+	defer scope.mu.Unlock()
+
+	stat, ok := scope.stats[fp]
+	if !ok {
+		stat = &queryScopeStat{}
+		scope.stats[fp] = stat
+	}
+	stat.count++
+	if operation != "" && !containsString(stat.operations, operation) {
+		stat.operations = append(stat.operations, operation)
+	}
+	if caller != "" && len(stat.callers) < nPlusOneMaxCallers && !containsString(stat.callers, caller) {
+		stat.callers = append(stat.callers, caller)
+	}
+
+	if stat.count <= threshold || scope.warned[fp] {
+		return nil
+	}
+	scope.warned[fp] = true
+	return &queryScopeStat{
+		count:      stat.count,
+		operations: append([]string(nil), stat.operations...),
+		callers:    append([]string(nil), stat.callers...),
+	}
+}
+
+// InterceptorNPlusOne warns when the same statement fingerprint runs more than threshold times within one query scope.
+// It is meant for development, statements outside WithQueryScope are not counted.
+func InterceptorNPlusOne(dsn *DSN, logger *zap.Logger, threshold int) Interceptor {
+	return func(action string, next Handler) Handler {
+		return func(db *gorm.DB) {
+			var (
+				ctx   context.Context
+				scope *queryScope
+			)
+			if ctx = db.Statement.Context; ctx == nil {
+				next(db)
+				return
+			}
+			if scope = queryScopeFrom(ctx); scope == nil {
+				next(db)
+				return
+			}
+
+			next(db)
+
+			fp := Fingerprint(dsn.Driver, db.Statement.SQL.String())
+			if fp == "" {
+				return
+			}
+			stat := scope.record(fp, OperationFrom(ctx), callerLocation(), threshold)
+			if stat == nil {
+				return
+			}
+
+			var message strings.Builder
+			message.WriteString("db.system=" + dsn.Driver)
+			message.WriteString("\t")
+			message.WriteString("db.connection_string=" + dsn.Addr)
+			message.WriteString("\t")
+			message.WriteString("db.name=" + dsn.DbName)
+			message.WriteString("\t")
+			message.WriteString("db.fingerprint=" + fp)
+			message.WriteString("\t")
+			message.WriteString("count=" + strconv.Itoa(stat.count))
+			message.WriteString("\t")
+
+			logger.Warn(message.String(),
+				zap.String("trace_id", trace.SpanContextFromContext(ctx).TraceID().String()),
+				zap.String("span_id", trace.SpanContextFromContext(ctx).SpanID().String()),
+				zap.String("n_plus_one", "true"),
+				zap.Strings("operations", stat.operations),
+				zap.Strings("callers", stat.callers),
+			)
+		}
+	}
+}
+
+// callerLocation returns the first frame outside of gorm and gormbox, which is where the statement was issued.
+func callerLocation() string {
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs)])
+	for {
+		frame, more := frames.Next()
+		internal := strings.Contains(frame.File, "gorm.io/") || strings.HasPrefix(frame.File, gormboxSourceDir)
+		if !internal || strings.HasSuffix(frame.File, "_test.go") {
+			return frame.File + ":" + strconv.Itoa(frame.Line)
+		}
+		if !more {
+			return ""
+		}
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,28 @@
+package gormbox
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"gorm.io/gorm"
+	"testing"
+)
+
+func TestInterceptorNPlusOne(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	handler := InterceptorNPlusOne(&DSN{Driver: DriverMysql}, zap.New(core), 2)("gorm:query", func(db *gorm.DB) {})
+
+	ctx := WithQueryScope(WithOperation(context.Background(), "user.get"))
+	for i := 0; i < 5; i++ {
+		db := &gorm.DB{Statement: &gorm.Statement{Context: ctx}}
+		db.Statement.SQL.WriteString("SELECT * FROM user WHERE id = ?")
+		handler(db)
+	}
+
+	require.Equal(t, 1, logs.Len())
+	fields := logs.All()[0].ContextMap()
+	require.Equal(t, []interface{}{"user.get"}, fields["operations"])
+	require.Contains(t, fields["callers"].([]interface{})[0], "nplusone_test.go")
+}
@@ -0,0 +1,187 @@
+package gormbox
+
+import (
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/callbacks"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+	"reflect"
+	"sync"
+)
+
+// ErrStaleObject fails the update of a record changed since it was read, see InterceptorOptimisticLock.
+var ErrStaleObject = errors.New("gormbox: stale object")
+
+const versionTag = "version"
+
+type versionLookup struct {
+	field *schema.Field
+	err   error
+}
+
+// versionFields caches the version field of the schemas, by *schema.Schema
+var versionFields sync.Map
+
+// versionField returns the field of s tagged `gormbox:"version"`, nil when s has none.
+func versionField(s *schema.Schema) (*schema.Field, error) {
+	if lookup, ok := versionFields.Load(s); ok {
+		return lookup.(*versionLookup).field, lookup.(*versionLookup).err
+	}
+	lookup := &versionLookup{}
+	for _, field := range s.Fields {
+		if field.DBName == "" || field.Tag.Get("gormbox") != versionTag {
+			continue
+		}
+		if field.DataType != schema.Int && field.DataType != schema.Uint {
+			lookup.err = fmt.Errorf("gormbox: version field %s of %s is not an integer", field.Name, s.Table)
+		}
+		lookup.field = field
+		break
+	}
+	versionFields.Store(s, lookup)
+	return lookup.field, lookup.err
+}
+
+// InterceptorOptimisticLock versions the models having an integer field tagged `gormbox:"version"`.
+// Creates start the version at 1, updates of a record add "version = <version read>" to their conditions
+// and increment it, so that the update of a record changed since it was read affects no row and fails
+// with ErrStaleObject. Records with a zero version, e.g. not read first, and slices are updated unchecked.
+func InterceptorOptimisticLock(dsn *DSN) Interceptor {
+	return func(action string, next Handler) Handler {
+		switch action {
+		case "gorm:create":
+			return func(db *gorm.DB) {
+				if db.Error != nil || db.Statement.Schema == nil {
+					next(db)
+					return
+				}
+				field, err := versionField(db.Statement.Schema)
+				if err == nil && field != nil {
+					err = versionInit(db, field)
+				}
+				if err != nil {
+					_ = db.AddError(err)
+					return
+				}
+				next(db)
+			}
+		case "gorm:update":
+			return func(db *gorm.DB) {
+				stmt := db.Statement
+				if db.Error != nil || stmt.Schema == nil || stmt.SQL.Len() > 0 {
+					next(db)
+					return
+				}
+				field, err := versionField(stmt.Schema)
+				if err != nil {
+					_ = db.AddError(err)
+					return
+				}
+				if field == nil {
+					next(db)
+					return
+				}
+
+				var version int64
+				if stmt.ReflectValue.Kind() == reflect.Struct {
+					if value, zero := field.ValueOf(stmt.Context, stmt.ReflectValue); !zero {
+						version = reflect.Indirect(reflect.ValueOf(value)).Convert(reflect.TypeOf(version)).Int()
+					}
+				}
+
+				restore, ok := versionIncrement(stmt, field)
+				if !ok {
+					// nothing to update
+					next(db)
+					return
+				}
+				defer restore()
+				if version > 0 {
+					stmt.AddClause(clause.Where{Exprs: []clause.Expression{
+						clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: field.DBName}, Value: version},
+					}})
+				}
+
+				next(db)
+
+				if db.Error != nil || db.DryRun || version == 0 {
+					return
+				}
+				if db.RowsAffected == 0 {
+					lockConflictTotals.WithLabelValues(dsn.Name, stmt.Table).Inc()
+					_ = db.AddError(fmt.Errorf("%w: %s %s=%d", ErrStaleObject, stmt.Table, field.DBName, version))
+					return
+				}
+				if stmt.ReflectValue.CanAddr() {
+					_ = field.Set(stmt.Context, stmt.ReflectValue, version+1)
+				}
+			}
+		}
+		return next
+	}
+}
+
+// versionIncrement adds "version = version + 1" to the assignments of the update, in place of any
+// assignment of version. It returns false when the update has nothing to assign, and restores the
+// statement clauses through restore.
+func versionIncrement(stmt *gorm.Statement, field *schema.Field) (restore func(), ok bool) {
+	c, exists := stmt.Clauses["SET"]
+	var set clause.Set
+	if exists {
+		set, _ = c.Expression.(clause.Set)
+	} else if set = callbacks.ConvertToAssignments(stmt); stmt.Error != nil || len(set) == 0 {
+		return nil, false
+	}
+
+	assignments := make(clause.Set, 0, len(set)+1)
+	for _, assignment := range set {
+		if assignment.Column.Name != field.DBName {
+			assignments = append(assignments, assignment)
+		}
+	}
+	assignments = append(assignments, clause.Assignment{
+		Column: clause.Column{Name: field.DBName},
+		Value:  gorm.Expr("? + 1", clause.Column{Table: clause.CurrentTable, Name: field.DBName}),
+	})
+	stmt.AddClause(assignments)
+
+	return func() {
+		if exists {
+			stmt.Clauses["SET"] = c
+		} else {
+			delete(stmt.Clauses, "SET")
+		}
+	}, true
+}
+
+// versionInit starts the version of the records being created at 1, unless set.
+func versionInit(db *gorm.DB, field *schema.Field) error {
+	if dest, ok := db.Statement.Dest.(map[string]interface{}); ok {
+		if _, ok = dest[field.DBName]; !ok {
+			dest[field.DBName] = 1
+		}
+		return nil
+	}
+
+	set := func(rv reflect.Value) error {
+		if _, zero := field.ValueOf(db.Statement.Context, rv); !zero {
+			return nil
+		}
+		return field.Set(db.Statement.Context, rv, 1)
+	}
+
+	rv := reflect.Indirect(db.Statement.ReflectValue)
+	switch rv.Kind() {
+	case reflect.Struct:
+		return set(rv)
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			if err := set(reflect.Indirect(rv.Index(i))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
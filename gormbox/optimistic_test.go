@@ -0,0 +1,55 @@
+package gormbox
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+type versionedItem struct {
+	ID      int64
+	Name    string
+	Stock   int
+	Version int64 `gormbox:"version"`
+}
+
+type badVersionItem struct {
+	ID      int64
+	Version string `gormbox:"version"`
+}
+
+func TestInterceptorOptimisticLock(t *testing.T) {
+	db := sqliteDB(t)
+	require.NoError(t, db.AutoMigrate(&versionedItem{}, &badVersionItem{}))
+	Intercept(db, InterceptorOptimisticLock(&DSN{Name: "test"}))
+
+	item := versionedItem{Name: "apple", Stock: 10}
+	require.NoError(t, db.Create(&item).Error)
+	require.Equal(t, int64(1), item.Version)
+
+	var a, b versionedItem
+	require.NoError(t, db.First(&a, item.ID).Error)
+	require.NoError(t, db.First(&b, item.ID).Error)
+
+	a.Stock = 5
+	require.NoError(t, db.Save(&a).Error)
+	require.Equal(t, int64(2), a.Version)
+
+	b.Stock = 7
+	err := db.Save(&b).Error
+	require.ErrorIs(t, err, ErrStaleObject)
+	require.True(t, IsStaleObject(err))
+	require.EqualError(t, err, "gormbox: stale object: versioned_items version=1")
+
+	require.NoError(t, db.Model(&a).Updates(map[string]interface{}{"stock": 4, "version": 100}).Error)
+	require.Equal(t, int64(3), a.Version)
+	require.ErrorIs(t, db.Model(&b).Update("stock", 3).Error, ErrStaleObject)
+
+	// not read first, updated unchecked
+	require.NoError(t, db.Model(&versionedItem{ID: item.ID}).Update("name", "pear").Error)
+
+	var got versionedItem
+	require.NoError(t, db.First(&got, item.ID).Error)
+	require.Equal(t, versionedItem{ID: item.ID, Name: "pear", Stock: 4, Version: 4}, got)
+
+	require.EqualError(t, db.Create(&badVersionItem{}).Error, "gormbox: version field Version of bad_version_items is not an integer")
+}
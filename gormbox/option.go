@@ -1,9 +1,112 @@
 package gormbox
 
-import "go.uber.org/zap"
+import (
+	"go.uber.org/zap"
+	"time"
+)
 
 type Option func(*options)
 
 type options struct {
 	logger *zap.Logger
+	name   string
+
+	explainThreshold time.Duration
+	explainInterval  time.Duration
+
+	nPlusOneThreshold int
+
+	maxFingerprints int
+
+	cache Cache
+
+	secretProvider SecretProvider
+	secretRefresh  time.Duration
+
+	drainTimeout time.Duration
+
+	shardings []*Sharding
+
+	replicas *Replicas
+
+	budget bool
+
+	tenantColumn string
+
+	auditSink   AuditSink
+	auditTables []string
+
+	recorder bool
+}
+
+func OptionLogger(logger *zap.Logger) Option {
+	return func(o *options) { o.logger = logger }
+}
+
+// OptionName sets the logical name of the db, it is added to the metric labels.
+func OptionName(name string) Option {
+	return func(o *options) { o.name = name }
+}
+
+// OptionSlowExplain runs EXPLAIN on statements slower than threshold, at most once per interval, in the
+// background: the plan is logged after the statement, see InterceptorExplain.
+func OptionSlowExplain(threshold, interval time.Duration) Option {
+	return func(o *options) { o.explainThreshold, o.explainInterval = threshold, interval }
+}
+
+// OptionNPlusOneDetect warns when a statement repeats more than threshold times within a query scope, see WithQueryScope.
+func OptionNPlusOneDetect(threshold int) Option {
+	return func(o *options) { o.nPlusOneThreshold = threshold }
+}
+
+// OptionFingerprintMetrics exports metrics by statement fingerprint, keeping at most maxFingerprints label values.
+func OptionFingerprintMetrics(maxFingerprints int) Option {
+	return func(o *options) { o.maxFingerprints = maxFingerprints }
+}
+
+// OptionCache caches the queries issued with WithCacheTTL in cache.
+func OptionCache(cache Cache) Option {
+	return func(o *options) { o.cache = cache }
+}
+
+// OptionSecretProvider resolves the password with provider whenever a connection is opened,
+// connections are recycled every refresh so that rotated credentials take effect.
+func OptionSecretProvider(provider SecretProvider, refresh time.Duration) Option {
+	return func(o *options) { o.secretProvider, o.secretRefresh = provider, refresh }
+}
+
+// OptionDrainTimeout is how long a Handle keeps the replaced db open after a reload swapped it.
+func OptionDrainTimeout(timeout time.Duration) Option {
+	return func(o *options) { o.drainTimeout = timeout }
+}
+
+// OptionSharding routes the statements on the sharded tables, see Sharding.
+func OptionSharding(shardings ...*Sharding) Option {
+	return func(o *options) { o.shardings = append(o.shardings, shardings...) }
+}
+
+// OptionReplicas sends the reads to replicas, see Replicas.
+func OptionReplicas(replicas *Replicas) Option {
+	return func(o *options) { o.replicas = replicas }
+}
+
+// OptionQueryBudget counts the statements against the budget of their context, see WithBudget.
+func OptionQueryBudget() Option {
+	return func(o *options) { o.budget = true }
+}
+
+// OptionTenant scopes the models having column to the tenant of the context, see WithTenant.
+// Raw statements need a tenant too, schema changes such as AutoMigrate run WithoutTenant.
+func OptionTenant(column string) Option {
+	return func(o *options) { o.tenantColumn = column }
+}
+
+// OptionAudit hands the changes of tables to sink, see WithActor.
+func OptionAudit(sink AuditSink, tables ...string) Option {
+	return func(o *options) { o.auditSink, o.auditTables = sink, append(o.auditTables, tables...) }
+}
+
+// OptionRecorder records the statements issued with WithRecorder.
+func OptionRecorder() Option {
+	return func(o *options) { o.recorder = true }
 }
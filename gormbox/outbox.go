@@ -0,0 +1,229 @@
+package gormbox
+
+import (
+	"context"
+	"errors"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+var ErrOutboxNotInTx = errors.New("gormbox: outbox event published outside a transaction")
+
+// OutboxEvent is a row of the outbox table, create the table with db.AutoMigrate(&OutboxEvent{}).
+type OutboxEvent struct {
+	ID            int64  `gorm:"primaryKey"`
+	Topic         string `gorm:"size:191;not null"`
+	Key           string `gorm:"size:191"`
+	Payload       []byte
+	Headers       map[string]string `gorm:"serializer:json;type:text"`
+	Attempts      int               `gorm:"not null;default:0"`
+	NextAttemptAt time.Time         `gorm:"index:idx_gormbox_outbox_pending,priority:2"`
+	PublishedAt   *time.Time        `gorm:"index:idx_gormbox_outbox_pending,priority:1"`
+	LastError     string            `gorm:"type:text"`
+	CreatedAt     time.Time
+}
+
+func (OutboxEvent) TableName() string {
+	return "gormbox_outbox"
+}
+
+// PublishInTx stores events in the outbox within tx, so that they are relayed if and only if tx commits.
+func PublishInTx(tx *gorm.DB, events ...*OutboxEvent) error {
+	if _, ok := tx.Statement.ConnPool.(gorm.TxCommitter); !ok {
+		return ErrOutboxNotInTx
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	now := time.Now()
+	for _, event := range events {
+		if event.NextAttemptAt.IsZero() {
+			event.NextAttemptAt = now
+		}
+	}
+	return tx.Create(&events).Error
+}
+
+type OutboxPublisher interface {
+	Publish(ctx context.Context, event *OutboxEvent) error
+}
+
+type OutboxPublisherFunc func(ctx context.Context, event *OutboxEvent) error
+
+func (f OutboxPublisherFunc) Publish(ctx context.Context, event *OutboxEvent) error {
+	return f(ctx, event)
+}
+
+type OutboxOption func(*outboxOptions)
+
+type outboxOptions struct {
+	name        string
+	logger      *zap.Logger
+	interval    time.Duration
+	batch       int
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+	maxAttempts int
+}
+
+// OutboxOptionName is the logical name of the db in the metric labels.
+func OutboxOptionName(name string) OutboxOption {
+	return func(o *outboxOptions) { o.name = name }
+}
+
+func OutboxOptionLogger(logger *zap.Logger) OutboxOption {
+	return func(o *outboxOptions) { o.logger = logger }
+}
+
+// OutboxOptionInterval is how often the relay polls when the outbox is drained.
+func OutboxOptionInterval(interval time.Duration) OutboxOption {
+	return func(o *outboxOptions) { o.interval = interval }
+}
+
+// OutboxOptionBatch is how many events the relay dispatches per poll.
+func OutboxOptionBatch(batch int) OutboxOption {
+	return func(o *outboxOptions) { o.batch = batch }
+}
+
+// OutboxOptionBackoff delays the retry of a failed event by min, doubled after every attempt up to max.
+func OutboxOptionBackoff(min, max time.Duration) OutboxOption {
+	return func(o *outboxOptions) { o.minBackoff, o.maxBackoff = min, max }
+}
+
+// OutboxOptionMaxAttempts gives up on an event after attempts failures, it stays in the outbox with its last error.
+// Zero retries forever.
+func OutboxOptionMaxAttempts(attempts int) OutboxOption {
+	return func(o *outboxOptions) { o.maxAttempts = attempts }
+}
+
+// OutboxRelay dispatches the pending outbox events to a publisher, at least once: an event published right
+// before the relay dies is published again. Events are claimed with SELECT ... FOR UPDATE SKIP LOCKED on mysql
+// and postgres, so several relays can run side by side. Events of the same key may be reordered by retries.
+type OutboxRelay struct {
+	db        *gorm.DB
+	publisher OutboxPublisher
+	options   *outboxOptions
+}
+
+func NewOutboxRelay(db *gorm.DB, publisher OutboxPublisher, opts ...OutboxOption) *OutboxRelay {
+	options := &outboxOptions{
+		logger:      globalLogger,
+		interval:    time.Second,
+		batch:       100,
+		minBackoff:  time.Second,
+		maxBackoff:  5 * time.Minute,
+		maxAttempts: 20,
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return &OutboxRelay{db: db, publisher: publisher, options: options}
+}
+
+// Run relays until ctx is done. A full batch is followed by the next poll right away.
+func (r *OutboxRelay) Run(ctx context.Context) error {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-timer.C:
+		}
+
+		n, err := r.RelayOnce(ctx)
+		if err != nil && ctx.Err() == nil {
+			r.options.logger.Error("gormbox outbox relay error",
+				zap.String("exception_msg", err.Error()),
+				zap.String("exception_type", "gorm"),
+			)
+		}
+		if err == nil && n >= r.options.batch {
+			timer.Reset(0)
+		} else {
+			timer.Reset(r.options.interval)
+		}
+	}
+}
+
+// RelayOnce dispatches one batch of due events and returns how many of them were claimed.
+func (r *OutboxRelay) RelayOnce(ctx context.Context) (int, error) {
+	var events []*OutboxEvent
+
+	ctx = WithOperation(ctx, "outbox_relay")
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		query := tx.Where("published_at IS NULL AND next_attempt_at <= ?", now)
+		if r.options.maxAttempts > 0 {
+			query = query.Where("attempts < ?", r.options.maxAttempts)
+		}
+		switch tx.Dialector.Name() {
+		case DriverMysql, "postgres":
+			query = query.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"})
+		}
+		if err := query.Order("id").Limit(r.options.batch).Find(&events).Error; err != nil {
+			return err
+		}
+
+		for _, event := range events {
+			if err := r.dispatch(ctx, tx, event); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return len(events), err
+}
+
+func (r *OutboxRelay) dispatch(ctx context.Context, tx *gorm.DB, event *OutboxEvent) error {
+	publishErr := r.publisher.Publish(ctx, event)
+
+	now := time.Now()
+	event.Attempts++
+	updates := map[string]interface{}{"attempts": event.Attempts}
+	if publishErr == nil {
+		updates["published_at"], updates["last_error"] = now, ""
+	} else {
+		updates["next_attempt_at"], updates["last_error"] = now.Add(r.backoff(event.Attempts)), publishErr.Error()
+	}
+	if err := tx.Model(event).Updates(updates).Error; err != nil {
+		return err
+	}
+
+	switch {
+	case publishErr == nil:
+		outboxTotals.WithLabelValues(r.options.name, event.Topic, "success").Inc()
+		outboxLag.WithLabelValues(r.options.name, event.Topic).Observe(now.Sub(event.CreatedAt).Seconds())
+	case r.options.maxAttempts > 0 && event.Attempts >= r.options.maxAttempts:
+		outboxTotals.WithLabelValues(r.options.name, event.Topic, "dead").Inc()
+		r.options.logger.Error("gormbox outbox event dead",
+			zap.Int64("outbox.id", event.ID),
+			zap.String("outbox.topic", event.Topic),
+			zap.Int("outbox.attempts", event.Attempts),
+			zap.String("exception_msg", publishErr.Error()),
+			zap.String("exception_type", "outbox"),
+		)
+	default:
+		outboxTotals.WithLabelValues(r.options.name, event.Topic, "failure").Inc()
+	}
+	return nil
+}
+
+func (r *OutboxRelay) backoff(attempts int) time.Duration {
+	return backoffDelay(r.options.minBackoff, r.options.maxBackoff, attempts)
+}
+
+// backoffDelay is min doubled after every attempt but the first, up to max.
+func backoffDelay(min, max time.Duration, attempts int) time.Duration {
+	backoff := min
+	for i := 1; i < attempts && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+	return backoff
+}
@@ -0,0 +1,103 @@
+package gormbox
+
+import (
+	"context"
+	"errors"
+	"github.com/glebarez/sqlite"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"testing"
+	"time"
+)
+
+func sqliteDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	sqlDB, err := db.DB()
+	require.NoError(t, err)
+	// every connection would open its own in-memory database
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = sqlDB.Close() })
+	return db
+}
+
+func TestOutboxRelay(t *testing.T) {
+	db := sqliteDB(t)
+	require.NoError(t, db.AutoMigrate(&OutboxEvent{}))
+	ctx := context.Background()
+
+	require.ErrorIs(t, PublishInTx(db, &OutboxEvent{Topic: "user.created"}), ErrOutboxNotInTx)
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		return PublishInTx(tx, &OutboxEvent{Topic: "user.created", Key: "1", Payload: []byte(`{"id":1}`), Headers: map[string]string{"source": "test"}})
+	})
+	require.NoError(t, err)
+	_ = db.Transaction(func(tx *gorm.DB) error {
+		require.NoError(t, PublishInTx(tx, &OutboxEvent{Topic: "user.created", Key: "2"}))
+		return errors.New("rollback")
+	})
+
+	var (
+		published []*OutboxEvent
+		fail      = true
+	)
+	publisher := OutboxPublisherFunc(func(ctx context.Context, event *OutboxEvent) error {
+		if fail {
+			return errors.New("broker down")
+		}
+		published = append(published, event)
+		return nil
+	})
+	relay := NewOutboxRelay(db, publisher, OutboxOptionLogger(zap.NewNop()), OutboxOptionBackoff(20*time.Millisecond, time.Second))
+
+	n, err := relay.RelayOnce(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	var event OutboxEvent
+	require.NoError(t, db.First(&event).Error)
+	require.Equal(t, 1, event.Attempts)
+	require.Equal(t, "broker down", event.LastError)
+	require.Nil(t, event.PublishedAt)
+
+	// backing off
+	n, err = relay.RelayOnce(ctx)
+	require.NoError(t, err)
+	require.Zero(t, n)
+
+	time.Sleep(30 * time.Millisecond)
+	fail = false
+	n, err = relay.RelayOnce(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.Len(t, published, 1)
+	require.Equal(t, "1", published[0].Key)
+	require.Equal(t, []byte(`{"id":1}`), published[0].Payload)
+	require.Equal(t, map[string]string{"source": "test"}, published[0].Headers)
+
+	require.NoError(t, db.First(&event).Error)
+	require.Equal(t, 2, event.Attempts)
+	require.NotNil(t, event.PublishedAt)
+
+	n, err = relay.RelayOnce(ctx)
+	require.NoError(t, err)
+	require.Zero(t, n)
+}
+
+func TestOutboxRelay_MaxAttempts(t *testing.T) {
+	db := sqliteDB(t)
+	require.NoError(t, db.AutoMigrate(&OutboxEvent{}))
+	require.NoError(t, db.Transaction(func(tx *gorm.DB) error {
+		return PublishInTx(tx, &OutboxEvent{Topic: "order.paid"})
+	}))
+
+	publisher := OutboxPublisherFunc(func(ctx context.Context, event *OutboxEvent) error { return errors.New("rejected") })
+	relay := NewOutboxRelay(db, publisher, OutboxOptionLogger(zap.NewNop()), OutboxOptionBackoff(0, 0), OutboxOptionMaxAttempts(2))
+
+	for _, expect := range []int{1, 1, 0} {
+		n, err := relay.RelayOnce(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, expect, n)
+	}
+}
@@ -0,0 +1,146 @@
+package gormbox
+
+import (
+	"context"
+	"fmt"
+	"gorm.io/gorm"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type recorderKey struct{}
+
+type RecordEntry struct {
+	Operation    string
+	Action       string // create, update, delete, query, row or raw
+	SQL          string
+	Vars         []interface{}
+	RowsAffected int64
+	Err          error
+	Duration     time.Duration
+}
+
+// Recorder collects the statements executed, keeping the first size of them.
+type Recorder struct {
+	mu      sync.Mutex
+	size    int
+	entries []RecordEntry
+	dropped int
+}
+
+// NewRecorder keeps at most size entries, zero keeps them all.
+func NewRecorder(size int) *Recorder {
+	return &Recorder{size: size}
+}
+
+// WithRecorder records the statements issued with ctx into r, see OptionRecorder.
+func WithRecorder(ctx context.Context, r *Recorder) context.Context {
+	return context.WithValue(ctx, recorderKey{}, r)
+}
+
+func RecorderFrom(ctx context.Context) *Recorder {
+	r, _ := ctx.Value(recorderKey{}).(*Recorder)
+	return r
+}
+
+func (r *Recorder) Entries() []RecordEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]RecordEntry(nil), r.entries...)
+}
+
+// Dropped is how many statements were not kept because the recorder was full.
+func (r *Recorder) Dropped() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.dropped
+}
+
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries, r.dropped = nil, 0
+}
+
+// Snapshot renders the entries one per line without their durations, so that it is stable across runs
+// as long as the statements and their vars are.
+func (r *Recorder) Snapshot() string {
+	var b strings.Builder
+	for _, entry := range r.Entries() {
+		b.WriteString("[" + entry.Operation + "] " + entry.Action + ": " + entry.SQL)
+		if len(entry.Vars) > 0 {
+			b.WriteString(" | vars=" + fmt.Sprint(entry.Vars))
+		}
+		b.WriteString(" | rows=" + strconv.FormatInt(entry.RowsAffected, 10))
+		if entry.Err != nil {
+			b.WriteString(" | err=" + entry.Err.Error())
+		}
+		b.WriteString("\n")
+	}
+	if dropped := r.Dropped(); dropped > 0 {
+		b.WriteString("... " + strconv.Itoa(dropped) + " dropped\n")
+	}
+	return b.String()
+}
+
+// Interceptor records every statement of the db it intercepts into r, whatever the context.
+func (r *Recorder) Interceptor() Interceptor {
+	return func(action string, next Handler) Handler {
+		return func(db *gorm.DB) {
+			st := time.Now()
+			next(db)
+			r.record(action, db, time.Since(st))
+		}
+	}
+}
+
+func (r *Recorder) record(action string, db *gorm.DB, duration time.Duration) {
+	if db.Statement.SQL.Len() == 0 {
+		return
+	}
+	entry := RecordEntry{
+		Action:       strings.TrimPrefix(action, "gorm:"),
+		SQL:          db.Statement.SQL.String(),
+		Vars:         append([]interface{}(nil), db.Statement.Vars...),
+		RowsAffected: db.RowsAffected,
+		Err:          db.Error,
+		Duration:     duration,
+	}
+	if ctx := db.Statement.Context; ctx != nil {
+		entry.Operation = OperationFrom(ctx)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.size > 0 && len(r.entries) >= r.size {
+		r.dropped++
+		return
+	}
+	r.entries = append(r.entries, entry)
+}
+
+// InterceptorRecorder records the statements issued with a context carrying WithRecorder.
+func InterceptorRecorder() Interceptor {
+	return func(action string, next Handler) Handler {
+		return func(db *gorm.DB) {
+			var (
+				ctx context.Context
+				r   *Recorder
+			)
+			if ctx = db.Statement.Context; ctx == nil {
+				next(db)
+				return
+			}
+			if r = RecorderFrom(ctx); r == nil {
+				next(db)
+				return
+			}
+
+			st := time.Now()
+			next(db)
+			r.record(action, db, time.Since(st))
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package gormbox
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+type recorderItem struct {
+	ID   int64
+	Name string
+}
+
+func TestInterceptorRecorder(t *testing.T) {
+	db := sqliteDB(t)
+	require.NoError(t, db.AutoMigrate(&recorderItem{}))
+	Intercept(db, InterceptorRecorder())
+
+	r := NewRecorder(2)
+	ctx := WithRecorder(WithOperation(context.Background(), "item.save"), r)
+	require.NoError(t, db.WithContext(ctx).Create(&recorderItem{Name: "a"}).Error)
+	require.NoError(t, db.Create(&recorderItem{Name: "not recorded"}).Error)
+
+	var items []recorderItem
+	require.NoError(t, db.WithContext(ctx).Where("name = ?", "a").Find(&items).Error)
+	require.Error(t, db.WithContext(ctx).Exec("DELETE FROM missing").Error)
+
+	entries := r.Entries()
+	require.Len(t, entries, 2)
+	require.Equal(t, 1, r.Dropped())
+	require.Equal(t, "item.save", entries[0].Operation)
+	require.Equal(t, "create", entries[0].Action)
+	require.Equal(t, "query", entries[1].Action)
+	require.Equal(t, int64(1), entries[1].RowsAffected)
+	require.Positive(t, entries[1].Duration)
+
+	require.Equal(t, "[item.save] create: INSERT INTO `recorder_items` (`name`) VALUES (?) RETURNING `id` | vars=[a] | rows=1\n"+
+		"[item.save] query: SELECT * FROM `recorder_items` WHERE name = ? | vars=[a] | rows=1\n"+
+		"... 1 dropped\n", r.Snapshot())
+
+	r.Reset()
+	require.Empty(t, r.Entries())
+	require.Zero(t, r.Dropped())
+}
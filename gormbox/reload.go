@@ -0,0 +1,190 @@
+package gormbox
+
+import (
+	"errors"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+	"gorm.io/gorm"
+	"sync"
+	"time"
+)
+
+var ErrHandleClosed = errors.New("gormbox: handle closed")
+
+// Handle holds a db that follows config changes at runtime.
+// Get the db from DB() for every unit of work instead of keeping it, a reload may swap it.
+type Handle struct {
+	mu     sync.RWMutex
+	db     *gorm.DB
+	dsn    *DSN
+	config *Config
+	rawDSN string
+
+	reloadMu sync.Mutex
+	opts     []Option
+	options  *options
+
+	// closed stops the drains of the replaced dbs, which Close waits for
+	closed    chan struct{}
+	closeOnce sync.Once
+	drains    sync.WaitGroup
+}
+
+func NewHandle(config *Config, opts ...Option) (*Handle, error) {
+	options := &options{logger: globalLogger, drainTimeout: 30 * time.Second}
+	for _, opt := range opts {
+		opt(options)
+	}
+	h := &Handle{opts: opts, options: options, closed: make(chan struct{})}
+
+	// the handle keeps config, which build completes
+	config = proto.Clone(config).(*Config)
+	db, dsn, rawDSN, err := h.build(config)
+	if err != nil {
+		return nil, err
+	}
+	h.db, h.dsn, h.config, h.rawDSN = db, dsn, config, rawDSN
+	return h, nil
+}
+
+func (h *Handle) DB() *gorm.DB {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.db
+}
+
+func (h *Handle) DSN() *DSN {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.dsn
+}
+
+// Reload applies config, which it doesn't modify. Pool settings are changed in place when the dsn stays
+// the same, otherwise a new db is built and swapped in while the old pool drains. A failing build keeps
+// the current db.
+func (h *Handle) Reload(config *Config) error {
+	h.reloadMu.Lock()
+	defer h.reloadMu.Unlock()
+	select {
+	case <-h.closed:
+		return ErrHandleClosed
+	default:
+	}
+
+	config = proto.Clone(config).(*Config)
+	h.mu.RLock()
+	current, currentDSN, currentRawDSN := h.db, h.dsn, h.rawDSN
+	currentDriver := h.config.GetDriver()
+	h.mu.RUnlock()
+
+	rawDSN, err := config.FormatDSN()
+	if err != nil {
+		h.reloaded(currentDSN, "config", err)
+		return err
+	}
+	driver := config.GetDriver()
+	if driver == "" {
+		driver = DriverMysql
+	}
+
+	if driver == currentDriver && rawDSN == currentRawDSN {
+		sqlDB, err := current.DB()
+		if err != nil {
+			h.reloaded(currentDSN, "pool", err)
+			return err
+		}
+		config.Driver = driver
+		config.applyPool(sqlDB, h.options)
+
+		h.mu.Lock()
+		h.config = config
+		h.mu.Unlock()
+		h.reloaded(currentDSN, "pool", nil)
+		return nil
+	}
+
+	db, dsn, rawDSN, err := h.build(config)
+	if err != nil {
+		h.reloaded(currentDSN, "dsn", err)
+		return err
+	}
+	h.mu.Lock()
+	h.db, h.dsn, h.config, h.rawDSN = db, dsn, config, rawDSN
+	h.mu.Unlock()
+	h.reloaded(dsn, "dsn", nil)
+
+	h.drains.Add(1)
+	go h.drain(current, currentDSN)
+	return nil
+}
+
+// Close closes the db, and the replaced ones still draining right away.
+func (h *Handle) Close() error {
+	h.reloadMu.Lock()
+	h.closeOnce.Do(func() { close(h.closed) })
+	h.reloadMu.Unlock()
+	h.drains.Wait()
+
+	sqlDB, err := h.DB().DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
+
+func (h *Handle) build(config *Config) (*gorm.DB, *DSN, string, error) {
+	db, dsn, err := config.build(h.opts...)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	rawDSN, err := config.FormatDSN()
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return db, dsn, rawDSN, nil
+}
+
+// drain stops keeping idle connections of the replaced db and closes it once in-flight work had time to finish,
+// or the handle is closed.
+func (h *Handle) drain(db *gorm.DB, dsn *DSN) {
+	defer h.drains.Done()
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		return
+	}
+	sqlDB.SetMaxIdleConns(0)
+	timer := time.NewTimer(h.options.drainTimeout)
+	select {
+	case <-timer.C:
+	case <-h.closed:
+		timer.Stop()
+	}
+	if err = sqlDB.Close(); err != nil {
+		h.options.logger.Error("gormbox drain error",
+			zap.String("db.system", dsn.Driver),
+			zap.String("db.connection_string", dsn.Addr),
+			zap.String("exception_msg", err.Error()),
+			zap.String("exception_type", "gorm"),
+		)
+	}
+}
+
+func (h *Handle) reloaded(dsn *DSN, kind string, err error) {
+	fields := []zap.Field{
+		zap.String("db.system", dsn.Driver),
+		zap.String("db.connection_string", dsn.Addr),
+		zap.String("db.name", dsn.DbName),
+		zap.String("reload", kind),
+	}
+	if err != nil {
+		reloadTotals.WithLabelValues(dsn.Name, dsn.Addr, dsn.DbName, "failure").Inc()
+		h.options.logger.Error("gormbox reload error", append(fields,
+			zap.String("exception_msg", err.Error()),
+			zap.String("exception_type", "gorm"),
+		)...)
+		return
+	}
+	reloadTotals.WithLabelValues(dsn.Name, dsn.Addr, dsn.DbName, "success").Inc()
+	h.options.logger.Info("gormbox reload", fields...)
+}
@@ -0,0 +1,100 @@
+package gormbox
+
+import (
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/server"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type mysqlServerHandler struct {
+	server.EmptyHandler
+}
+
+func (mysqlServerHandler) UseDB(string) error { return nil }
+
+func (mysqlServerHandler) HandleQuery(query string) (*mysql.Result, error) {
+	if strings.HasPrefix(strings.ToUpper(query), "SELECT") {
+		resultset, err := mysql.BuildSimpleTextResultset([]string{"value"}, [][]interface{}{{"8.0.30"}})
+		if err != nil {
+			return nil, err
+		}
+		return &mysql.Result{Resultset: resultset}, nil
+	}
+	return &mysql.Result{}, nil
+}
+
+// mysqlServer serves the mysql protocol on a port of its own, answering every select with a single row,
+// enough for Build.
+func mysqlServer(t *testing.T) int32 {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				c, err := server.NewConn(conn, "root", "", mysqlServerHandler{})
+				if err != nil {
+					return
+				}
+				for c.HandleCommand() == nil {
+				}
+			}()
+		}
+	}()
+	return int32(listener.Addr().(*net.TCPAddr).Port)
+}
+
+func TestHandle_Reload(t *testing.T) {
+	first, second := mysqlServer(t), mysqlServer(t)
+	config := &Config{Host: "127.0.0.1", Port: first, User: "root", Database: "test"}
+	h, err := NewHandle(config, OptionLogger(zap.NewNop()), OptionDrainTimeout(time.Hour))
+	require.NoError(t, err)
+	require.Empty(t, config.Driver, "the config of the caller is left alone")
+
+	// the pool settings apply in place
+	old := h.DB()
+	reload := &Config{Host: "127.0.0.1", Port: first, User: "root", Database: "test", MaxOpenConns: 3}
+	require.NoError(t, h.Reload(reload))
+	require.Empty(t, reload.Driver)
+	require.Same(t, old, h.DB())
+	sqlDB, err := old.DB()
+	require.NoError(t, err)
+	require.Equal(t, 3, sqlDB.Stats().MaxOpenConnections)
+
+	// another dsn swaps the db
+	require.NoError(t, h.Reload(&Config{Host: "127.0.0.1", Port: second, User: "root", Database: "test"}))
+	require.NotSame(t, old, h.DB())
+	require.Equal(t, "127.0.0.1:"+strconv.Itoa(int(second)), h.DSN().Addr)
+	require.NoError(t, h.DB().Exec("SET @a = 1").Error)
+
+	// a failing build keeps the current db
+	current := h.DB()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, listener.Close())
+	down := int32(listener.Addr().(*net.TCPAddr).Port)
+	require.Error(t, h.Reload(&Config{Host: "127.0.0.1", Port: down, User: "root", Database: "test"}))
+	require.Same(t, current, h.DB())
+	require.NoError(t, h.DB().Exec("SET @a = 1").Error)
+
+	// closing doesn't wait for the drain of the replaced db, it closes it
+	st := time.Now()
+	require.NoError(t, h.Close())
+	require.Less(t, time.Since(st), time.Second)
+	require.EqualError(t, sqlDB.Ping(), "sql: database is closed")
+	sqlDB, err = current.DB()
+	require.NoError(t, err)
+	require.EqualError(t, sqlDB.Ping(), "sql: database is closed")
+	require.ErrorIs(t, h.Reload(config), ErrHandleClosed)
+}
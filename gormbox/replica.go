@@ -0,0 +1,401 @@
+package gormbox
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	replicaLagTimeout = 5 * time.Second
+	// replicaGTIDSnapshots bounds the gtid sets of the primary a replica has yet to apply
+	replicaGTIDSnapshots = 64
+)
+
+var (
+	replicaSelect  = regexp.MustCompile(`(?is)^\s*(\(\s*)*select\b`)
+	replicaLocking = regexp.MustCompile(`(?i)\bfor\s+(update|share)\b|\block\s+in\s+share\s+mode\b`)
+)
+
+type primaryKey struct{}
+
+type consistencySessionKey struct{}
+
+type consistencyTokenKey struct{}
+
+// consistencySession remembers the last write of a unit of work.
+type consistencySession struct {
+	lastWrite int64
+}
+
+// WithPrimary sends the reads issued with ctx to the primary.
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryKey{}, true)
+}
+
+// WithConsistencySession makes the reads issued with ctx go to the primary for a while after a write
+// issued with ctx, see ReplicaOptionWindow.
+func WithConsistencySession(ctx context.Context) context.Context {
+	return context.WithValue(ctx, consistencySessionKey{}, &consistencySession{})
+}
+
+// WithConsistencyToken is WithConsistencySession across contexts, e.g. the requests of a user session:
+// the writes and reads issued with the same token are tracked together.
+func WithConsistencyToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, consistencyTokenKey{}, token)
+}
+
+// ReplicaLagChecker returns how far replica is behind its primary.
+type ReplicaLagChecker func(ctx context.Context, replica *sql.DB) (time.Duration, error)
+
+type ReplicaOption func(*replicaOptions)
+
+type replicaOptions struct {
+	name        string
+	logger      *zap.Logger
+	window      time.Duration
+	lagInterval time.Duration
+	maxLag      time.Duration
+	lagChecker  ReplicaLagChecker
+}
+
+// ReplicaOptionName is the logical name of the db in the metric labels.
+func ReplicaOptionName(name string) ReplicaOption {
+	return func(o *replicaOptions) { o.name = name }
+}
+
+func ReplicaOptionLogger(logger *zap.Logger) ReplicaOption {
+	return func(o *replicaOptions) { o.logger = logger }
+}
+
+// ReplicaOptionWindow is how long the reads stay on the primary after a write of the same session or token.
+func ReplicaOptionWindow(window time.Duration) ReplicaOption {
+	return func(o *replicaOptions) { o.window = window }
+}
+
+// ReplicaOptionLagCheck checks the lag of every replica each interval with checker, ReplicaLagMysql by default,
+// see ReplicaLagMysqlGTID.
+// A replica more than maxLag behind, or failing the check, is out of rotation until it catches up.
+func ReplicaOptionLagCheck(interval, maxLag time.Duration, checker ReplicaLagChecker) ReplicaOption {
+	return func(o *replicaOptions) { o.lagInterval, o.maxLag, o.lagChecker = interval, maxLag, checker }
+}
+
+type replica struct {
+	db      *gorm.DB
+	name    string
+	healthy int32
+}
+
+// Replicas spreads the reads over replica dbs round robin and keeps the writes on the primary,
+// the db built with OptionReplicas.
+type Replicas struct {
+	replicas []*replica
+	options  *replicaOptions
+	next     uint32
+
+	mu     sync.Mutex
+	tokens map[string]time.Time
+	swept  time.Time
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewReplicas(dbs []*gorm.DB, opts ...ReplicaOption) *Replicas {
+	options := &replicaOptions{logger: globalLogger, window: 5 * time.Second}
+	for _, opt := range opts {
+		opt(options)
+	}
+	r := &Replicas{options: options, tokens: make(map[string]time.Time), done: make(chan struct{})}
+	for i, db := range dbs {
+		r.replicas = append(r.replicas, &replica{db: db, name: strconv.Itoa(i), healthy: 1})
+	}
+
+	if options.lagInterval > 0 {
+		if options.lagChecker == nil {
+			options.lagChecker = ReplicaLagMysql
+		}
+		r.wg.Add(1)
+		go r.run()
+	}
+	return r
+}
+
+// Close stops checking the lag, the replica dbs are left open.
+func (r *Replicas) Close() {
+	select {
+	case <-r.done:
+	default:
+		close(r.done)
+	}
+	r.wg.Wait()
+}
+
+func (r *Replicas) run() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.options.lagInterval)
+	defer ticker.Stop()
+
+	for {
+		r.CheckLag(context.Background())
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CheckLag checks every replica once and takes the lagging ones out of rotation.
+func (r *Replicas) CheckLag(ctx context.Context) {
+	for _, replica := range r.replicas {
+		healthy := int32(1)
+		lag, err := r.lag(ctx, replica)
+		if err != nil {
+			healthy = 0
+			r.options.logger.Error("gormbox replica lag check error",
+				zap.String("db.replica", replica.name),
+				zap.String("exception_msg", err.Error()),
+				zap.String("exception_type", "gorm"),
+			)
+		} else {
+			replicaLag.WithLabelValues(r.options.name, replica.name).Set(lag.Seconds())
+			if r.options.maxLag > 0 && lag > r.options.maxLag {
+				healthy = 0
+			}
+		}
+
+		if atomic.SwapInt32(&replica.healthy, healthy) != healthy {
+			r.options.logger.Warn("gormbox replica rotation",
+				zap.String("db.replica", replica.name),
+				zap.Bool("healthy", healthy == 1),
+				zap.Duration("lag", lag),
+			)
+		}
+	}
+}
+
+func (r *Replicas) lag(ctx context.Context, replica *replica) (time.Duration, error) {
+	sqlDB, err := replica.db.DB()
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, replicaLagTimeout)
+	defer cancel()
+	return r.options.lagChecker(ctx, sqlDB)
+}
+
+// ReplicaLagMysql reads Seconds_Behind_Master of SHOW SLAVE STATUS, a replica not replicating is an error.
+func ReplicaLagMysql(ctx context.Context, replica *sql.DB) (time.Duration, error) {
+	rows, err := replica.QueryContext(ctx, "SHOW SLAVE STATUS")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return 0, err
+		}
+		return 0, errors.New("gormbox: replica is not replicating")
+	}
+	values := make([]sql.NullString, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err = rows.Scan(dest...); err != nil {
+		return 0, err
+	}
+	for i, column := range columns {
+		if column != "Seconds_Behind_Master" {
+			continue
+		}
+		if !values[i].Valid {
+			return 0, errors.New("gormbox: replica sql thread is not running")
+		}
+		seconds, err := strconv.ParseInt(values[i].String, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return 0, errors.New("gormbox: SHOW SLAVE STATUS without Seconds_Behind_Master")
+}
+
+type replicaGTIDSnapshot struct {
+	at       time.Time
+	executed string
+}
+
+// ReplicaLagMysqlGTID measures the lag with the gtid sets of primary, for replicas with gtid_mode=ON,
+// rather than Seconds_Behind_Master, which reads 0 while the io thread catches up. Every check takes
+// the gtid_executed of primary, the lag is the age of the oldest set the replica has not applied yet,
+// with the resolution of the check interval.
+func ReplicaLagMysqlGTID(primary *sql.DB) ReplicaLagChecker {
+	var (
+		mu      sync.Mutex
+		pending = make(map[*sql.DB][]replicaGTIDSnapshot)
+	)
+	return func(ctx context.Context, replica *sql.DB) (time.Duration, error) {
+		var executed string
+		if err := primary.QueryRowContext(ctx, "SELECT @@GLOBAL.gtid_executed").Scan(&executed); err != nil {
+			return 0, err
+		}
+		now := time.Now()
+
+		mu.Lock()
+		defer mu.Unlock()
+		snapshots := pending[replica]
+		// past the bound the oldest sets, which give the lag, are kept
+		if len(snapshots) < replicaGTIDSnapshots {
+			snapshots = append(snapshots, replicaGTIDSnapshot{at: now, executed: executed})
+		}
+		// the sets only grow, the applied ones come first
+		applied := 0
+		for ; applied < len(snapshots); applied++ {
+			var subset bool
+			err := replica.QueryRowContext(ctx, "SELECT GTID_SUBSET(?, @@GLOBAL.gtid_executed)", snapshots[applied].executed).Scan(&subset)
+			if err != nil {
+				pending[replica] = snapshots
+				return 0, err
+			}
+			if !subset {
+				break
+			}
+		}
+		snapshots = snapshots[applied:]
+		pending[replica] = snapshots
+		if len(snapshots) == 0 {
+			return 0, nil
+		}
+		return now.Sub(snapshots[0].at), nil
+	}
+}
+
+// pick returns the next healthy replica, nil when none is.
+func (r *Replicas) pick() *replica {
+	n := len(r.replicas)
+	for i := 0; i < n; i++ {
+		replica := r.replicas[int(atomic.AddUint32(&r.next, 1)-1)%n]
+		if atomic.LoadInt32(&replica.healthy) == 1 {
+			return replica
+		}
+	}
+	return nil
+}
+
+// lagging tells whether a replica is out of rotation.
+func (r *Replicas) lagging() bool {
+	for _, replica := range r.replicas {
+		if atomic.LoadInt32(&replica.healthy) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Replicas) wrote(ctx context.Context) {
+	now := time.Now()
+	if session, ok := ctx.Value(consistencySessionKey{}).(*consistencySession); ok {
+		atomic.StoreInt64(&session.lastWrite, now.UnixNano())
+	}
+	if token, ok := ctx.Value(consistencyTokenKey{}).(string); ok && token != "" {
+		r.mu.Lock()
+		// forget the expired tokens once per window
+		if now.Sub(r.swept) > r.options.window {
+			for t, at := range r.tokens {
+				if now.Sub(at) > r.options.window {
+					delete(r.tokens, t)
+				}
+			}
+			r.swept = now
+		}
+		r.tokens[token] = now
+		r.mu.Unlock()
+	}
+}
+
+// primary tells whether the reads of ctx have to see its writes.
+func (r *Replicas) primary(ctx context.Context) bool {
+	if primary, _ := ctx.Value(primaryKey{}).(bool); primary {
+		return true
+	}
+	now := time.Now()
+	if session, ok := ctx.Value(consistencySessionKey{}).(*consistencySession); ok {
+		if lastWrite := atomic.LoadInt64(&session.lastWrite); lastWrite > 0 && now.Sub(time.Unix(0, lastWrite)) <= r.options.window {
+			return true
+		}
+	}
+	if token, ok := ctx.Value(consistencyTokenKey{}).(string); ok && token != "" {
+		r.mu.Lock()
+		at, ok := r.tokens[token]
+		r.mu.Unlock()
+		if ok && now.Sub(at) <= r.options.window {
+			return true
+		}
+	}
+	return false
+}
+
+// InterceptorReplica sends the reads to the replicas of r and tracks the writes for read-your-writes.
+// The reads are the queries and the rows, see gorm.DB.Rows, raw ones included as long as their sql is a
+// select; locking reads, e.g. SELECT ... FOR UPDATE, go to the primary, as Exec always does.
+// Statements inside a transaction stay on its connection.
+func InterceptorReplica(dsn *DSN, r *Replicas) Interceptor {
+	return func(action string, next Handler) Handler {
+		return func(db *gorm.DB) {
+			ctx := db.Statement.Context
+			if ctx == nil || db.Error != nil {
+				next(db)
+				return
+			}
+
+			if !replicaRead(action, db.Statement) {
+				next(db)
+				if db.Error == nil {
+					r.wrote(ctx)
+				}
+				return
+			}
+
+			target := "primary"
+			if _, ok := db.Statement.ConnPool.(gorm.TxCommitter); !ok && !r.primary(ctx) {
+				if replica := r.pick(); replica != nil {
+					db.Statement.ConnPool = replica.db.ConnPool
+					target = "replica_" + replica.name
+				}
+			}
+			replicaTotals.WithLabelValues(dsn.Name, target).Inc()
+
+			next(db)
+		}
+	}
+}
+
+// replicaRead tells whether the statement can run on a replica: a query without locking clause,
+// whose raw sql if any is a select without locking either.
+func replicaRead(action string, stmt *gorm.Statement) bool {
+	if action != "gorm:query" && action != "gorm:row" {
+		return false
+	}
+	if _, ok := stmt.Clauses["FOR"]; ok {
+		return false
+	}
+	if stmt.SQL.Len() == 0 {
+		return true
+	}
+	return replicaSelect.MatchString(stmt.SQL.String()) && !replicaLocking.MatchString(stmt.SQL.String())
+}
@@ -0,0 +1,184 @@
+package gormbox
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type replicaItem struct {
+	ID   int64
+	Name string
+}
+
+// replicaDBs returns a primary intercepted by InterceptorReplica and its replica,
+// two databases of their own so that the reads tell where they went.
+func replicaDBs(t *testing.T, opts ...ReplicaOption) (*gorm.DB, *gorm.DB, *Replicas) {
+	primary, replica := sqliteDB(t), sqliteDB(t)
+	for _, db := range []*gorm.DB{primary, replica} {
+		require.NoError(t, db.AutoMigrate(&replicaItem{}))
+	}
+	require.NoError(t, replica.Create(&replicaItem{Name: "replica"}).Error)
+
+	r := NewReplicas([]*gorm.DB{replica}, opts...)
+	t.Cleanup(r.Close)
+	Intercept(primary, InterceptorReplica(&DSN{Name: "test"}, r))
+	return primary, replica, r
+}
+
+func replicaNames(t *testing.T, db *gorm.DB) []string {
+	var names []string
+	require.NoError(t, db.Model(&replicaItem{}).Order("id").Pluck("name", &names).Error)
+	return names
+}
+
+func TestInterceptorReplica(t *testing.T) {
+	db, _, _ := replicaDBs(t)
+	ctx := context.Background()
+
+	require.NoError(t, db.WithContext(ctx).Create(&replicaItem{Name: "primary"}).Error)
+	require.Equal(t, []string{"replica"}, replicaNames(t, db.WithContext(ctx)))
+	require.Equal(t, []string{"primary"}, replicaNames(t, db.WithContext(WithPrimary(ctx))))
+
+	// rows and raw selects are reads too
+	var name string
+	require.NoError(t, db.WithContext(ctx).Model(&replicaItem{}).Select("name").Row().Scan(&name))
+	require.Equal(t, "replica", name)
+	require.NoError(t, db.WithContext(ctx).Raw("SELECT name FROM replica_items").Scan(&name).Error)
+	require.Equal(t, "replica", name)
+	require.NoError(t, db.WithContext(ctx).Raw("SELECT name FROM replica_items").Row().Scan(&name))
+	require.Equal(t, "replica", name)
+
+	require.NoError(t, db.WithContext(ctx).Exec("UPDATE replica_items SET name = ?", "updated").Error)
+
+	// a transaction stays on its connection
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		require.Equal(t, []string{"updated"}, replicaNames(t, tx))
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestInterceptorReplica_ReadYourWrites(t *testing.T) {
+	db, _, _ := replicaDBs(t, ReplicaOptionWindow(100*time.Millisecond))
+
+	session := WithConsistencySession(context.Background())
+	require.Equal(t, []string{"replica"}, replicaNames(t, db.WithContext(session)))
+	require.NoError(t, db.WithContext(session).Create(&replicaItem{Name: "primary"}).Error)
+	require.Equal(t, []string{"primary"}, replicaNames(t, db.WithContext(session)))
+	// another session doesn't have to see the write
+	require.Equal(t, []string{"replica"}, replicaNames(t, db.WithContext(WithConsistencySession(context.Background()))))
+
+	token := WithConsistencyToken(context.Background(), "user-1")
+	require.NoError(t, db.WithContext(token).Create(&replicaItem{Name: "token"}).Error)
+	// the token is shared across contexts
+	other := WithConsistencyToken(context.Background(), "user-1")
+	require.Equal(t, []string{"primary", "token"}, replicaNames(t, db.WithContext(other)))
+	require.Equal(t, []string{"replica"}, replicaNames(t, db.WithContext(WithConsistencyToken(context.Background(), "user-2"))))
+
+	time.Sleep(150 * time.Millisecond)
+	require.Equal(t, []string{"replica"}, replicaNames(t, db.WithContext(session)))
+	require.Equal(t, []string{"replica"}, replicaNames(t, db.WithContext(other)))
+}
+
+func TestReplicas_CheckLag(t *testing.T) {
+	var lag, down int64
+	checked := make(chan struct{}, 1)
+	checker := func(ctx context.Context, replica *sql.DB) (time.Duration, error) {
+		select {
+		case checked <- struct{}{}:
+		default:
+		}
+		if atomic.LoadInt64(&down) == 1 {
+			return 0, errors.New("replica down")
+		}
+		return time.Duration(atomic.LoadInt64(&lag)), nil
+	}
+	db, _, r := replicaDBs(t, ReplicaOptionLagCheck(time.Hour, time.Second, checker))
+	// the first check runs right away, the next one in an hour
+	<-checked
+	ctx := context.Background()
+	require.NoError(t, db.WithContext(WithPrimary(ctx)).Create(&replicaItem{Name: "primary"}).Error)
+	require.Equal(t, []string{"replica"}, replicaNames(t, db.WithContext(ctx)))
+
+	atomic.StoreInt64(&lag, int64(time.Minute))
+	r.CheckLag(ctx)
+	require.Equal(t, []string{"primary"}, replicaNames(t, db.WithContext(ctx)))
+
+	atomic.StoreInt64(&lag, 0)
+	r.CheckLag(ctx)
+	require.Equal(t, []string{"replica"}, replicaNames(t, db.WithContext(ctx)))
+
+	atomic.StoreInt64(&down, 1)
+	r.CheckLag(ctx)
+	require.Equal(t, []string{"primary"}, replicaNames(t, db.WithContext(ctx)))
+}
+
+func TestReplicaRead(t *testing.T) {
+	db, _ := dryRunDB(t)
+	stmt := func(tx *gorm.DB) *gorm.Statement {
+		return tx.Find(&[]replicaItem{}).Statement
+	}
+	require.True(t, replicaRead("gorm:query", stmt(db.Session(&gorm.Session{}))))
+	require.False(t, replicaRead("gorm:query", stmt(db.Clauses(clause.Locking{Strength: "UPDATE"}))))
+	require.False(t, replicaRead("gorm:create", stmt(db.Session(&gorm.Session{}))))
+
+	raw := func(sql string) *gorm.Statement {
+		return db.Raw(sql).Statement
+	}
+	require.True(t, replicaRead("gorm:row", raw("SELECT name FROM replica_items")))
+	require.True(t, replicaRead("gorm:query", raw(" (select 1) union (select 2)")))
+	require.False(t, replicaRead("gorm:row", raw("SELECT name FROM replica_items WHERE id = 1 FOR UPDATE")))
+	require.False(t, replicaRead("gorm:query", raw("select * from replica_items lock in share mode")))
+	require.False(t, replicaRead("gorm:row", raw("INSERT INTO replica_items (name) VALUES ('a') RETURNING id")))
+}
+
+func TestReplicaLagMysqlGTID(t *testing.T) {
+	primary, primaryMock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer primary.Close()
+	replica, replicaMock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer replica.Close()
+	checker := ReplicaLagMysqlGTID(primary)
+	ctx := context.Background()
+
+	expect := func(executed string, applied ...bool) {
+		primaryMock.ExpectQuery(`SELECT @@GLOBAL.gtid_executed`).WillReturnRows(sqlmock.NewRows([]string{"gtid"}).AddRow(executed))
+		for _, subset := range applied {
+			replicaMock.ExpectQuery(`SELECT GTID_SUBSET\(\?, @@GLOBAL.gtid_executed\)`).WillReturnRows(sqlmock.NewRows([]string{"subset"}).AddRow(subset))
+		}
+	}
+
+	expect("a:1-5", true)
+	lag, err := checker(ctx, replica)
+	require.NoError(t, err)
+	require.Zero(t, lag)
+
+	expect("a:1-7", false)
+	_, err = checker(ctx, replica)
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+
+	// a:1-7 is still missing
+	expect("a:1-9", false)
+	lag, err = checker(ctx, replica)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, lag, 20*time.Millisecond)
+
+	// caught up with a:1-7, not with a:1-9 taken since
+	expect("a:1-9", true, false)
+	lag, err = checker(ctx, replica)
+	require.NoError(t, err)
+	require.Less(t, lag, 20*time.Millisecond)
+
+	require.NoError(t, primaryMock.ExpectationsWereMet())
+	require.NoError(t, replicaMock.ExpectationsWereMet())
+}
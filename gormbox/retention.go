@@ -0,0 +1,302 @@
+package gormbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+var ErrRetentionLagging = errors.New("gormbox: retention held too long by a lagging replica")
+
+// the pause between two lag checks when batches don't sleep
+const retentionLagPoll = time.Second
+
+// RetentionPolicy purges the rows of Table soft deleted more than After ago.
+type RetentionPolicy struct {
+	Table   string
+	After   time.Duration
+	Column  string // the soft delete column, "deleted_at" by default
+	Key     string // the primary key, "id" by default
+	Archive string // copies the rows into this table, of the same columns, before deleting them
+}
+
+type RetentionOption func(*retentionOptions)
+
+type retentionOptions struct {
+	name     string
+	logger   *zap.Logger
+	interval time.Duration
+	batch    int
+	sleep    time.Duration
+	maxRows  int64
+	replicas *Replicas
+	lagWait  time.Duration
+}
+
+// RetentionOptionName is the logical name of the db in the metric labels.
+func RetentionOptionName(name string) RetentionOption {
+	return func(o *retentionOptions) { o.name = name }
+}
+
+func RetentionOptionLogger(logger *zap.Logger) RetentionOption {
+	return func(o *retentionOptions) { o.logger = logger }
+}
+
+// RetentionOptionInterval is how often Run purges, 1h by default.
+func RetentionOptionInterval(interval time.Duration) RetentionOption {
+	return func(o *retentionOptions) { o.interval = interval }
+}
+
+// RetentionOptionBatch is how many rows a batch purges, each batch in a transaction of its own.
+func RetentionOptionBatch(batch int) RetentionOption {
+	return func(o *retentionOptions) { o.batch = batch }
+}
+
+// RetentionOptionSleep is the pause between two batches, which keeps the locks short and the replicas up.
+func RetentionOptionSleep(sleep time.Duration) RetentionOption {
+	return func(o *retentionOptions) { o.sleep = sleep }
+}
+
+// RetentionOptionMaxRows bounds the rows purged per table and run, the rest waits for the next run. Zero is unbounded.
+func RetentionOptionMaxRows(rows int64) RetentionOption {
+	return func(o *retentionOptions) { o.maxRows = rows }
+}
+
+// RetentionOptionReplicas holds the batches while a replica of replicas is out of rotation for lag,
+// see ReplicaOptionLagCheck.
+func RetentionOptionReplicas(replicas *Replicas) RetentionOption {
+	return func(o *retentionOptions) { o.replicas = replicas }
+}
+
+// RetentionOptionMaxLagWait is how long a table waits for the lagging replicas before its purge gives up
+// with ErrRetentionLagging until the next run, 10m by default. Zero waits for as long as they lag.
+func RetentionOptionMaxLagWait(wait time.Duration) RetentionOption {
+	return func(o *retentionOptions) { o.lagWait = wait }
+}
+
+// Retention purges the soft deleted rows of tables past their retention, in small batches.
+// Every statement goes through the gorm callbacks as operation "retention.<table>", and every
+// batch is traced and counted.
+type Retention struct {
+	db       *gorm.DB
+	policies []RetentionPolicy
+	options  *retentionOptions
+}
+
+func NewRetention(db *gorm.DB, policies []RetentionPolicy, opts ...RetentionOption) (*Retention, error) {
+	options := &retentionOptions{
+		logger:   globalLogger,
+		interval: time.Hour,
+		batch:    1000,
+		sleep:    100 * time.Millisecond,
+		maxRows:  100000,
+		lagWait:  10 * time.Minute,
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+	if options.batch <= 0 {
+		return nil, errors.New("gormbox: retention batch must be positive")
+	}
+
+	// the defaults are filled in a copy, the caller's policies are left alone
+	policies = append([]RetentionPolicy(nil), policies...)
+	for i := range policies {
+		policy := &policies[i]
+		if policy.Table == "" || policy.After <= 0 {
+			return nil, fmt.Errorf("gormbox: retention policy %d wants a table and a positive retention", i)
+		}
+		if policy.Column == "" {
+			policy.Column = "deleted_at"
+		}
+		if policy.Key == "" {
+			policy.Key = "id"
+		}
+	}
+	return &Retention{db: db, policies: policies, options: options}, nil
+}
+
+// Run purges every interval until ctx is done, starting right away.
+func (r *Retention) Run(ctx context.Context) error {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-timer.C:
+		}
+
+		if _, err := r.PurgeOnce(ctx); err != nil && ctx.Err() == nil {
+			r.options.logger.Error("gormbox retention error",
+				zap.String("exception_msg", err.Error()),
+				zap.String("exception_type", "gorm"),
+			)
+		}
+		timer.Reset(r.options.interval)
+	}
+}
+
+// PurgeOnce applies every policy once and returns the rows purged by table. A failing policy doesn't stop the others,
+// the first error is returned.
+func (r *Retention) PurgeOnce(ctx context.Context) (map[string]int64, error) {
+	purged := make(map[string]int64, len(r.policies))
+	var first error
+	for _, policy := range r.policies {
+		rows, err := r.purge(ctx, policy)
+		purged[policy.Table] = rows
+		if err != nil && first == nil {
+			first = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return purged, first
+}
+
+func (r *Retention) purge(ctx context.Context, policy RetentionPolicy) (int64, error) {
+	var (
+		purged int64
+		st     = time.Now()
+		cutoff = st.Add(-policy.After)
+	)
+	for r.options.maxRows <= 0 || purged < r.options.maxRows {
+		if err := r.throttle(ctx, policy.Table, purged > 0); err != nil {
+			return purged, err
+		}
+
+		limit := int64(r.options.batch)
+		if r.options.maxRows > 0 && r.options.maxRows-purged < limit {
+			limit = r.options.maxRows - purged
+		}
+		rows, err := r.batch(ctx, policy, cutoff, int(limit))
+		purged += rows
+		if err != nil {
+			return purged, err
+		}
+		if rows < limit {
+			break
+		}
+	}
+
+	r.options.logger.Info("gormbox retention",
+		zap.String("retention.table", policy.Table),
+		zap.String("retention.archive", policy.Archive),
+		zap.Int64("retention.rows", purged),
+		zap.Duration("latency", time.Since(st)),
+	)
+	return purged, nil
+}
+
+// throttle sleeps between two batches, and holds while a replica lags, for at most the max lag wait.
+func (r *Retention) throttle(ctx context.Context, table string, sleep bool) error {
+	var held time.Time
+	for {
+		pause := r.options.sleep
+		if !held.IsZero() && pause <= 0 {
+			pause = retentionLagPoll
+		}
+		if sleep && pause > 0 {
+			timer := time.NewTimer(pause)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if r.options.replicas == nil || !r.options.replicas.lagging() {
+			if !held.IsZero() {
+				r.options.logger.Info("gormbox retention resumed",
+					zap.String("retention.table", table),
+					zap.Duration("retention.held", time.Since(held)),
+				)
+			}
+			return nil
+		}
+		switch {
+		case held.IsZero():
+			held = time.Now()
+			r.options.logger.Warn("gormbox retention held by replica lag", zap.String("retention.table", table))
+		case r.options.lagWait > 0 && time.Since(held) >= r.options.lagWait:
+			return ErrRetentionLagging
+		}
+		sleep = true
+	}
+}
+
+// batch purges at most limit rows of policy deleted before cutoff and returns how many it purged.
+func (r *Retention) batch(ctx context.Context, policy RetentionPolicy, cutoff time.Time, limit int) (int64, error) {
+	action := "delete"
+	if policy.Archive != "" {
+		action = "archive"
+	}
+
+	ctx, span := otel.Tracer(r.db.Dialector.Name()).Start(ctx, "retention")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("db.sql.table", policy.Table),
+		attribute.String("db.retention.action", action),
+		attribute.Int("db.retention.batch", limit),
+	)
+
+	st := time.Now()
+	// the rows restored since the select are left alone
+	expired := clause.Expr{
+		SQL:  "? IS NOT NULL AND ? < ?",
+		Vars: []interface{}{clause.Column{Name: policy.Column}, clause.Column{Name: policy.Column}, cutoff},
+	}
+	var purged int64
+	// the retention applies across tenants
+	err := r.db.WithContext(WithoutTenant(WithOperation(ctx, "retention."+policy.Table))).Transaction(func(tx *gorm.DB) error {
+		var keys []interface{}
+		err := tx.Table(policy.Table).Where(expired).
+			Order(clause.OrderByColumn{Column: clause.Column{Name: policy.Key}}).
+			Limit(limit).Pluck(policy.Key, &keys).Error
+		if err != nil || len(keys) == 0 {
+			return err
+		}
+
+		in := clause.IN{Column: clause.Column{Name: policy.Key}, Values: keys}
+		if policy.Archive != "" {
+			err = tx.Exec("INSERT INTO ? SELECT * FROM ? WHERE ? AND ?",
+				clause.Table{Name: policy.Archive}, clause.Table{Name: policy.Table}, in, expired).Error
+			if err != nil {
+				return err
+			}
+		}
+		result := tx.Exec("DELETE FROM ? WHERE ? AND ?", clause.Table{Name: policy.Table}, in, expired)
+		purged = result.RowsAffected
+		return result.Error
+	})
+	latency := time.Since(st)
+
+	retentionLatency.WithLabelValues(r.options.name, policy.Table).Observe(latency.Seconds())
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return 0, err
+	}
+	span.SetAttributes(attribute.Int64("db.retention.rows", purged))
+	span.SetStatus(codes.Ok, "OK")
+	retentionTotals.WithLabelValues(r.options.name, policy.Table, action).Add(float64(purged))
+	r.options.logger.Debug("gormbox retention batch",
+		zap.String("retention.table", policy.Table),
+		zap.String("retention.action", action),
+		zap.Int64("retention.rows", purged),
+		zap.Duration("latency", latency),
+	)
+	return purged, nil
+}
@@ -0,0 +1,84 @@
+package gormbox
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"gorm.io/gorm"
+	"testing"
+	"time"
+)
+
+type retentionOrder struct {
+	ID        int64
+	Amount    int
+	DeletedAt gorm.DeletedAt
+}
+
+func TestRetention_PurgeOnce(t *testing.T) {
+	db := sqliteDB(t)
+	require.NoError(t, db.AutoMigrate(&retentionOrder{}))
+	require.NoError(t, db.Table("retention_orders_archive").AutoMigrate(&retentionOrder{}))
+
+	old := gorm.DeletedAt{Time: time.Now().Add(-10 * 24 * time.Hour), Valid: true}
+	recent := gorm.DeletedAt{Time: time.Now().Add(-time.Hour), Valid: true}
+	require.NoError(t, db.Create([]*retentionOrder{
+		{Amount: 1, DeletedAt: old},
+		{Amount: 2, DeletedAt: old},
+		{Amount: 3, DeletedAt: recent},
+		{Amount: 4},
+		{Amount: 5, DeletedAt: old},
+	}).Error)
+
+	r, err := NewRetention(db, []RetentionPolicy{{Table: "retention_orders", After: 7 * 24 * time.Hour, Archive: "retention_orders_archive"}},
+		RetentionOptionLogger(zap.NewNop()), RetentionOptionBatch(2), RetentionOptionSleep(0), RetentionOptionMaxRows(2))
+	require.NoError(t, err)
+
+	purged, err := r.PurgeOnce(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, map[string]int64{"retention_orders": 2}, purged)
+	purged, err = r.PurgeOnce(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, map[string]int64{"retention_orders": 1}, purged)
+
+	var amounts []int
+	require.NoError(t, db.Unscoped().Model(&retentionOrder{}).Order("id").Pluck("amount", &amounts).Error)
+	require.Equal(t, []int{3, 4}, amounts)
+	require.NoError(t, db.Table("retention_orders_archive").Order("id").Pluck("amount", &amounts).Error)
+	require.Equal(t, []int{1, 2, 5}, amounts)
+
+	_, err = NewRetention(db, []RetentionPolicy{{Table: "retention_orders"}})
+	require.EqualError(t, err, "gormbox: retention policy 0 wants a table and a positive retention")
+}
+
+func TestRetention_Throttle(t *testing.T) {
+	replicas := NewReplicas([]*gorm.DB{sqliteDB(t)})
+	replicas.replicas[0].healthy = 0
+	r, err := NewRetention(sqliteDB(t), nil, RetentionOptionSleep(time.Millisecond), RetentionOptionReplicas(replicas))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, r.throttle(ctx, "orders", false), context.DeadlineExceeded)
+
+	replicas.replicas[0].healthy = 1
+	require.NoError(t, r.throttle(context.Background(), "orders", true))
+
+	replicas.replicas[0].healthy = 0
+	core, logs := observer.New(zapcore.InfoLevel)
+	r, err = NewRetention(sqliteDB(t), nil, RetentionOptionSleep(time.Millisecond), RetentionOptionReplicas(replicas),
+		RetentionOptionMaxLagWait(time.Millisecond), RetentionOptionLogger(zap.New(core)))
+	require.NoError(t, err)
+	require.ErrorIs(t, r.throttle(context.Background(), "orders", false), ErrRetentionLagging)
+	require.Equal(t, 1, logs.FilterMessage("gormbox retention held by replica lag").Len())
+}
+
+func TestNewRetention_Defaults(t *testing.T) {
+	policies := []RetentionPolicy{{Table: "orders", After: time.Hour}}
+	r, err := NewRetention(sqliteDB(t), policies)
+	require.NoError(t, err)
+	require.Equal(t, RetentionPolicy{Table: "orders", After: time.Hour}, policies[0])
+	require.Equal(t, RetentionPolicy{Table: "orders", After: time.Hour, Column: "deleted_at", Key: "id"}, r.policies[0])
+}
@@ -0,0 +1,125 @@
+package gormbox
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"github.com/go-sql-driver/mysql"
+	"gorm.io/driver/clickhouse"
+	gormysql "gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// SecretProvider resolves the database password, it is asked every time a new connection is opened.
+type SecretProvider interface {
+	Password(ctx context.Context) (string, error)
+}
+
+type SecretProviderFunc func(ctx context.Context) (string, error)
+
+func (fn SecretProviderFunc) Password(ctx context.Context) (string, error) {
+	return fn(ctx)
+}
+
+// SecretFile reads the password from file, e.g. a mounted kubernetes secret.
+func SecretFile(path string) SecretProvider {
+	return SecretProviderFunc(func(ctx context.Context) (string, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	})
+}
+
+// SecretEnv reads the password from the environment variable name.
+func SecretEnv(name string) SecretProvider {
+	return SecretProviderFunc(func(ctx context.Context) (string, error) {
+		password, ok := os.LookupEnv(name)
+		if !ok {
+			return "", errors.New("gormbox: secret env " + name + " not set")
+		}
+		return password, nil
+	})
+}
+
+// secretConnector opens every connection with the password resolved at connect time.
+type secretConnector struct {
+	driver   driver.Driver
+	dsn      string
+	name     string
+	provider SecretProvider
+}
+
+func newSecretConnector(driverName, dsn string, provider SecretProvider) (*secretConnector, error) {
+	if _, err := dsnWithPassword(driverName, dsn, ""); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return &secretConnector{driver: db.Driver(), dsn: dsn, name: driverName, provider: provider}, nil
+}
+
+func (c *secretConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	password, err := c.provider.Password(ctx)
+	if err != nil {
+		return nil, err
+	}
+	dsn, err := dsnWithPassword(c.name, c.dsn, password)
+	if err != nil {
+		return nil, err
+	}
+	if dc, ok := c.driver.(driver.DriverContext); ok {
+		connector, err := dc.OpenConnector(dsn)
+		if err != nil {
+			return nil, err
+		}
+		return connector.Connect(ctx)
+	}
+	return c.driver.Open(dsn)
+}
+
+func (c *secretConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+func dsnWithPassword(driverName, dsn, password string) (string, error) {
+	switch driverName {
+	case DriverMysql:
+		c, err := mysql.ParseDSN(dsn)
+		if err != nil {
+			return "", err
+		}
+		c.Passwd = password
+		return c.FormatDSN(), nil
+	case DriverClickhouse:
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return "", err
+		}
+		params := u.Query()
+		username := params.Get("username")
+		if u.User != nil {
+			username = u.User.Username()
+		}
+		params.Del("username")
+		params.Del("password")
+		u.User, u.RawQuery = url.UserPassword(username, password), params.Encode()
+		return u.String(), nil
+	}
+	return "", &ConfigError{Field: "driver", Reason: "secret provider unsupported for driver " + driverName}
+}
+
+func dialectorWithConn(driverName string, conn gorm.ConnPool) gorm.Dialector {
+	if driverName == DriverClickhouse {
+		return clickhouse.New(clickhouse.Config{Conn: conn})
+	}
+	return gormysql.New(gormysql.Config{Conn: conn})
+}
@@ -0,0 +1,53 @@
+package gormbox
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSecretProviders(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "password")
+	require.NoError(t, os.WriteFile(path, []byte("s3cret\n"), 0600))
+	password, err := SecretFile(path).Password(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "s3cret", password)
+
+	t.Setenv("GORMBOX_TEST_PASSWORD", "from-env")
+	password, err = SecretEnv("GORMBOX_TEST_PASSWORD").Password(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "from-env", password)
+
+	_, err = SecretEnv("GORMBOX_TEST_MISSING").Password(context.Background())
+	require.Error(t, err)
+}
+
+func TestDsnWithPassword(t *testing.T) {
+	dsn, err := dsnWithPassword(DriverMysql, "root@tcp(127.0.0.1:3306)/web?parseTime=true", "p@ss")
+	require.NoError(t, err)
+	require.Equal(t, "root:p@ss@tcp(127.0.0.1:3306)/web?parseTime=true", dsn)
+
+	dsn, err = dsnWithPassword(DriverClickhouse, "tcp://host:9000?username=user&password=old&database=clicks", "new")
+	require.NoError(t, err)
+	parsed, err := GetParser(DriverClickhouse).ParseDSN(dsn)
+	require.NoError(t, err)
+	require.Equal(t, "user", parsed.Username)
+	require.Equal(t, "new", parsed.Password)
+	require.Equal(t, "clicks", parsed.DbName)
+}
+
+func TestSecretConnector(t *testing.T) {
+	var calls int
+	provider := SecretProviderFunc(func(ctx context.Context) (string, error) {
+		calls++
+		return "", context.Canceled
+	})
+	connector, err := newSecretConnector(DriverMysql, "root@tcp(127.0.0.1:3306)/web", provider)
+	require.NoError(t, err)
+
+	_, err = connector.Connect(context.Background())
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, 1, calls)
+}
@@ -0,0 +1,504 @@
+package gormbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"hash/crc32"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var shardingExprEq = regexp.MustCompile("^\\s*([\\w.`\"]+)\\s*=\\s*\\?\\s*$")
+
+var (
+	ErrMissingShardingKey = errors.New("gormbox: sharding key missing")
+	ErrCrossShard         = errors.New("gormbox: statement spans several shards")
+)
+
+type ShardingAlgorithm interface {
+	Shards() int
+	Shard(key interface{}) (int, error)
+}
+
+// ShardingKeyExtractor finds the value of the sharding column in a statement that is about to be built.
+type ShardingKeyExtractor func(db *gorm.DB, column string) (interface{}, error)
+
+type ShardingOption func(*Sharding)
+
+// ShardingOptionExtractor replaces ShardingKeyFromStatement.
+func ShardingOptionExtractor(extractor ShardingKeyExtractor) ShardingOption {
+	return func(s *Sharding) { s.extractor = extractor }
+}
+
+// ShardingOptionTableName replaces the default "<table>_<shard>" naming of the sharded tables.
+func ShardingOptionTableName(fn func(table string, shard int) string) ShardingOption {
+	return func(s *Sharding) { s.tableName = fn }
+}
+
+// Sharding splits table by column into algorithm.Shards() tables spread evenly over dbs,
+// shard i lives in dbs[i*len(dbs)/shards].
+type Sharding struct {
+	table     string
+	column    string
+	algorithm ShardingAlgorithm
+	dbs       []*gorm.DB
+	extractor ShardingKeyExtractor
+	tableName func(table string, shard int) string
+}
+
+// NewSharding fails when algorithm has no shard, without dbs, or with more dbs than shards.
+func NewSharding(table, column string, algorithm ShardingAlgorithm, dbs []*gorm.DB, opts ...ShardingOption) (*Sharding, error) {
+	if algorithm.Shards() <= 0 {
+		return nil, fmt.Errorf("gormbox: sharding %s has %d shards, want a positive number", table, algorithm.Shards())
+	}
+	if len(dbs) == 0 {
+		return nil, fmt.Errorf("gormbox: sharding %s without dbs", table)
+	}
+	if len(dbs) > algorithm.Shards() {
+		return nil, fmt.Errorf("gormbox: sharding %s has %d dbs for %d shards", table, len(dbs), algorithm.Shards())
+	}
+	s := &Sharding{
+		table:     table,
+		column:    column,
+		algorithm: algorithm,
+		dbs:       dbs,
+		extractor: ShardingKeyFromStatement,
+		tableName: func(table string, shard int) string { return table + "_" + strconv.Itoa(shard) },
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s, nil
+}
+
+// Route returns the index of the db and the name of the table holding key.
+func (s *Sharding) Route(key interface{}) (int, string, error) {
+	shard, err := s.algorithm.Shard(key)
+	if err != nil {
+		return 0, "", err
+	}
+	return shard * len(s.dbs) / s.algorithm.Shards(), s.tableName(s.table, shard), nil
+}
+
+// route routes key, or every key of ShardingKeys, which must share their shard.
+func (s *Sharding) route(key interface{}) (int, string, error) {
+	keys, ok := key.(ShardingKeys)
+	if !ok {
+		return s.Route(key)
+	}
+	var (
+		index int
+		table string
+	)
+	for i, key := range keys {
+		keyIndex, keyTable, err := s.Route(key)
+		if err != nil {
+			return 0, "", err
+		}
+		if i > 0 && (keyIndex != index || keyTable != table) {
+			return 0, "", fmt.Errorf("%w: %s.%s", ErrCrossShard, s.table, s.column)
+		}
+		index, table = keyIndex, keyTable
+	}
+	return index, table, nil
+}
+
+// DB returns the db holding key scoped to its table, transactions on a sharded table have to begin here.
+func (s *Sharding) DB(ctx context.Context, key interface{}) (*gorm.DB, error) {
+	index, table, err := s.Route(key)
+	if err != nil {
+		return nil, err
+	}
+	return s.dbs[index].WithContext(ctx).Table(table), nil
+}
+
+// InterceptorSharding routes the statements on the sharded tables to their db and table.
+// Statements inside a transaction keep their connection, only the table is rewritten, and fail with
+// ErrCrossShard when the transaction belongs to another db. The implicit transaction of a write, see
+// gorm.Config.SkipDefaultTransaction, is replaced by one on the shard db.
+func InterceptorSharding(dsn *DSN, shardings ...*Sharding) Interceptor {
+	tables := make(map[string]*Sharding, len(shardings))
+	for _, s := range shardings {
+		tables[s.table] = s
+	}
+
+	return func(action string, next Handler) Handler {
+		if action == "gorm:raw" {
+			return next
+		}
+		return func(db *gorm.DB) {
+			s, ok := tables[db.Statement.Table]
+			if !ok || db.Error != nil {
+				next(db)
+				return
+			}
+
+			key, err := s.extractor(db, s.column)
+			if err == nil && key == nil {
+				err = fmt.Errorf("%w: %s.%s", ErrMissingShardingKey, s.table, s.column)
+			}
+			var (
+				index int
+				table string
+			)
+			if err == nil {
+				index, table, err = s.route(key)
+			}
+			if err != nil {
+				_ = db.AddError(err)
+				return
+			}
+
+			db.Statement.Table = table
+			shard := s.dbs[index]
+			if _, ok := db.Statement.ConnPool.(gorm.TxCommitter); !ok {
+				db.Statement.ConnPool = shard.ConnPool
+			} else if db.ConnPool != shard.ConnPool {
+				if _, ok = db.InstanceGet("gorm:started_transaction"); !ok {
+					_ = db.AddError(fmt.Errorf("%w: %s in a transaction of another db than shard db %d", ErrCrossShard, table, index))
+					return
+				}
+				// the implicit transaction of the write was begun on this db, the write runs in a transaction
+				// of the shard db of its own, committed before the implicit one
+				tx := shard.Session(&gorm.Session{Context: db.Statement.Context, NewDB: true}).Begin()
+				if tx.Error != nil {
+					_ = db.AddError(tx.Error)
+					return
+				}
+				pool := db.Statement.ConnPool
+				db.Statement.ConnPool = tx.Statement.ConnPool
+				defer func() {
+					db.Statement.ConnPool = pool
+					if db.Error != nil {
+						tx.Rollback()
+					} else if err := tx.Commit().Error; err != nil {
+						_ = db.AddError(err)
+					}
+				}()
+			}
+
+			shardDB := strconv.Itoa(index)
+			trace.SpanFromContext(db.Statement.Context).SetAttributes(
+				attribute.String("db.sharding.table", table),
+				attribute.Int("db.sharding.db", index),
+			)
+			shardingTotals.WithLabelValues(dsn.Name, s.table, shardDB, table).Inc()
+
+			next(db)
+		}
+	}
+}
+
+// ShardingKeys are the keys of the records of a batch, all of them have to live in the same shard.
+type ShardingKeys []interface{}
+
+// ShardingKeyFromStatement looks for column in the where conditions, then in the model or the values being created.
+// The keys of a batch, of an IN list or of the branches of an OR are returned as ShardingKeys. Conditions that
+// can't be narrowed to keys, an OR branch without the column or a NOT on it, fail.
+func ShardingKeyFromStatement(db *gorm.DB, column string) (interface{}, error) {
+	if c, ok := db.Statement.Clauses["WHERE"]; ok {
+		if where, ok := c.Expression.(clause.Where); ok {
+			key, err := shardingKeyFromExprs(where.Exprs, column)
+			if err != nil || key != nil {
+				return key, err
+			}
+		}
+	}
+
+	if dest, ok := db.Statement.Dest.(map[string]interface{}); ok {
+		if key, ok := dest[column]; ok {
+			return key, nil
+		}
+	}
+	if db.Statement.Schema == nil || !db.Statement.ReflectValue.IsValid() {
+		return nil, nil
+	}
+	field := db.Statement.Schema.LookUpField(column)
+	if field == nil {
+		return nil, nil
+	}
+
+	rv := reflect.Indirect(db.Statement.ReflectValue)
+	switch rv.Kind() {
+	case reflect.Struct:
+		if value, zero := field.ValueOf(db.Statement.Context, rv); !zero {
+			return value, nil
+		}
+	case reflect.Slice, reflect.Array:
+		keys := make(ShardingKeys, 0, rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			value, zero := field.ValueOf(db.Statement.Context, reflect.Indirect(rv.Index(i)))
+			if zero {
+				return nil, nil
+			}
+			keys = append(keys, value)
+		}
+		if len(keys) == 0 {
+			return nil, nil
+		}
+		return keys, nil
+	}
+	return nil, nil
+}
+
+// shardingKeyFromExprs finds the key of column in exprs. gorm joins them with AND, but for the single
+// expression of an OrConditions which is joined with OR, so every OR branch needs a key of its own.
+func shardingKeyFromExprs(exprs []clause.Expression, column string) (interface{}, error) {
+	var (
+		key     interface{}
+		keys    ShardingKeys
+		negated bool
+		ored    bool
+	)
+	for i, expr := range exprs {
+		if or, ok := expr.(clause.OrConditions); ok && len(or.Exprs) == 1 && i > 0 {
+			if key == nil {
+				return nil, fmt.Errorf("%w: %s in every branch of an OR", ErrMissingShardingKey, column)
+			}
+			keys, key, ored = appendShardingKeys(keys, key), nil, true
+			expr = or.Exprs[0]
+		}
+		if not, ok := expr.(clause.NotConditions); ok {
+			negated = negated || shardingTouches(not.Exprs, column)
+			continue
+		}
+		if key != nil {
+			continue
+		}
+		termKey, err := shardingKeyFromExpr(expr, column)
+		if err != nil {
+			return nil, err
+		}
+		key = termKey
+	}
+
+	switch {
+	case ored && key == nil:
+		return nil, fmt.Errorf("%w: %s in every branch of an OR", ErrMissingShardingKey, column)
+	case ored:
+		return appendShardingKeys(keys, key), nil
+	case key == nil && negated:
+		return nil, fmt.Errorf("%w: NOT on %s", ErrCrossShard, column)
+	}
+	return key, nil
+}
+
+func shardingKeyFromExpr(expr clause.Expression, column string) (interface{}, error) {
+	switch e := expr.(type) {
+	case clause.Eq:
+		if shardingColumn(e.Column) == column {
+			return e.Value, nil
+		}
+	case clause.IN:
+		if shardingColumn(e.Column) == column && len(e.Values) == 1 {
+			return e.Values[0], nil
+		}
+		if shardingColumn(e.Column) == column && len(e.Values) > 1 {
+			return ShardingKeys(e.Values), nil
+		}
+	case clause.Expr:
+		// Where("user_id = ?", 1)
+		if m := shardingExprEq.FindStringSubmatch(e.SQL); m != nil && len(e.Vars) == 1 && shardingColumn(m[1]) == column {
+			return e.Vars[0], nil
+		}
+	case clause.AndConditions:
+		return shardingKeyFromExprs(e.Exprs, column)
+	case clause.OrConditions:
+		// Or(a, b), a parenthesized disjunction: a key narrows the statement only when every branch has one
+		var keys ShardingKeys
+		for _, branch := range e.Exprs {
+			key, err := shardingKeyFromExprs([]clause.Expression{branch}, column)
+			if err != nil || key == nil {
+				return nil, err
+			}
+			keys = appendShardingKeys(keys, key)
+		}
+		if len(keys) == 1 {
+			return keys[0], nil
+		}
+		return keys, nil
+	}
+	return nil, nil
+}
+
+func appendShardingKeys(keys ShardingKeys, key interface{}) ShardingKeys {
+	if more, ok := key.(ShardingKeys); ok {
+		return append(keys, more...)
+	}
+	return append(keys, key)
+}
+
+// shardingTouches tells whether exprs have a condition on column.
+func shardingTouches(exprs []clause.Expression, column string) bool {
+	for _, expr := range exprs {
+		var touches bool
+		switch e := expr.(type) {
+		case clause.Eq:
+			touches = shardingColumn(e.Column) == column
+		case clause.Neq:
+			touches = shardingColumn(e.Column) == column
+		case clause.IN:
+			touches = shardingColumn(e.Column) == column
+		case clause.Gt:
+			touches = shardingColumn(e.Column) == column
+		case clause.Gte:
+			touches = shardingColumn(e.Column) == column
+		case clause.Lt:
+			touches = shardingColumn(e.Column) == column
+		case clause.Lte:
+			touches = shardingColumn(e.Column) == column
+		case clause.Like:
+			touches = shardingColumn(e.Column) == column
+		case clause.Expr:
+			touches = shardingMentions(e.SQL, column)
+		case clause.AndConditions:
+			touches = shardingTouches(e.Exprs, column)
+		case clause.OrConditions:
+			touches = shardingTouches(e.Exprs, column)
+		case clause.NotConditions:
+			touches = shardingTouches(e.Exprs, column)
+		}
+		if touches {
+			return true
+		}
+	}
+	return false
+}
+
+// shardingMentions tells whether sql has column as a word of its own.
+func shardingMentions(sql, column string) bool {
+	word := func(c byte) bool {
+		return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+	}
+	for i := strings.Index(sql, column); i >= 0; {
+		end := i + len(column)
+		if (i == 0 || !word(sql[i-1])) && (end == len(sql) || !word(sql[end])) {
+			return true
+		}
+		next := strings.Index(sql[i+1:], column)
+		if next < 0 {
+			return false
+		}
+		i += next + 1
+	}
+	return false
+}
+
+func shardingColumn(column interface{}) string {
+	var name string
+	switch c := column.(type) {
+	case string:
+		name = c
+	case clause.Column:
+		name = c.Name
+	}
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		name = name[i+1:]
+	}
+	return strings.Trim(name, "`\"")
+}
+
+type shardingMod struct{ shards int }
+
+// ShardingMod picks key mod shards, string keys are hashed with crc32 first.
+func ShardingMod(shards int) ShardingAlgorithm {
+	return shardingMod{shards: shards}
+}
+
+func (a shardingMod) Shards() int { return a.shards }
+
+func (a shardingMod) Shard(key interface{}) (int, error) {
+	n, err := shardingHash(key)
+	if err != nil {
+		return 0, err
+	}
+	return int(n % uint64(a.shards)), nil
+}
+
+type shardingRange struct{ bounds []int64 }
+
+// ShardingRange puts key into shard i when bounds[i-1] <= key < bounds[i], it has len(bounds)+1 shards.
+func ShardingRange(bounds ...int64) ShardingAlgorithm {
+	bounds = append([]int64(nil), bounds...)
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+	return shardingRange{bounds: bounds}
+}
+
+func (a shardingRange) Shards() int { return len(a.bounds) + 1 }
+
+func (a shardingRange) Shard(key interface{}) (int, error) {
+	n, ok := shardingInt(key)
+	if !ok {
+		return 0, fmt.Errorf("gormbox: range sharding key must be an integer, got %T", key)
+	}
+	return sort.Search(len(a.bounds), func(i int) bool { return n < a.bounds[i] }), nil
+}
+
+type shardingConsistentHash struct {
+	shards int
+	ring   []uint32
+	nodes  map[uint32]int
+}
+
+// ShardingConsistentHash places replicas virtual nodes of every shard on a crc32 ring.
+func ShardingConsistentHash(shards, replicas int) ShardingAlgorithm {
+	a := shardingConsistentHash{shards: shards, nodes: make(map[uint32]int, shards*replicas)}
+	for shard := 0; shard < shards; shard++ {
+		for replica := 0; replica < replicas; replica++ {
+			hash := crc32.ChecksumIEEE([]byte(strconv.Itoa(shard) + "#" + strconv.Itoa(replica)))
+			a.ring = append(a.ring, hash)
+			a.nodes[hash] = shard
+		}
+	}
+	sort.Slice(a.ring, func(i, j int) bool { return a.ring[i] < a.ring[j] })
+	return a
+}
+
+func (a shardingConsistentHash) Shards() int { return a.shards }
+
+func (a shardingConsistentHash) Shard(key interface{}) (int, error) {
+	if len(a.ring) == 0 {
+		return 0, errors.New("gormbox: consistent hash sharding without nodes")
+	}
+	hash := crc32.ChecksumIEEE([]byte(fmt.Sprint(key)))
+	i := sort.Search(len(a.ring), func(i int) bool { return a.ring[i] >= hash })
+	if i == len(a.ring) {
+		i = 0
+	}
+	return a.nodes[a.ring[i]], nil
+}
+
+func shardingHash(key interface{}) (uint64, error) {
+	if n, ok := shardingInt(key); ok {
+		if n < 0 {
+			n = -n
+		}
+		return uint64(n), nil
+	}
+	switch k := key.(type) {
+	case string:
+		return uint64(crc32.ChecksumIEEE([]byte(k))), nil
+	case []byte:
+		return uint64(crc32.ChecksumIEEE(k)), nil
+	}
+	return 0, fmt.Errorf("gormbox: unsupported sharding key type %T", key)
+}
+
+func shardingInt(key interface{}) (int64, bool) {
+	rv := reflect.Indirect(reflect.ValueOf(key))
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rv.Uint()), true
+	}
+	return 0, false
+}
@@ -0,0 +1,131 @@
+package gormbox
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+	"strconv"
+	"testing"
+)
+
+type shardingOrder struct {
+	ID     int64
+	UserID int64
+}
+
+func (shardingOrder) TableName() string { return "orders" }
+
+func TestInterceptorSharding(t *testing.T) {
+	db0, statements := dryRunDB(t)
+	db1, _ := dryRunDB(t)
+	sharding, err := NewSharding("orders", "user_id", ShardingMod(4), []*gorm.DB{db0, db1})
+	require.NoError(t, err)
+	Intercept(db0, InterceptorSharding(&DSN{}, sharding))
+
+	var orders []shardingOrder
+	stmt := db0.Where("user_id = ?", 3).Find(&orders).Statement
+	require.NoError(t, stmt.Error)
+	require.Equal(t, "SELECT * FROM `orders_3` WHERE user_id = ?", stmt.SQL.String())
+	require.Equal(t, db1.ConnPool, stmt.ConnPool)
+
+	stmt = db0.Where(&shardingOrder{UserID: 5}).Find(&orders).Statement
+	require.NoError(t, stmt.Error)
+	require.Equal(t, "SELECT * FROM `orders_1` WHERE `orders_1`.`user_id` = ?", stmt.SQL.String())
+	require.Equal(t, db0.ConnPool, stmt.ConnPool)
+
+	require.NoError(t, db0.Create(&shardingOrder{ID: 1, UserID: 6}).Error)
+	require.Equal(t, []string{"INSERT INTO `orders_2` (`user_id`,`id`) VALUES (?,?)"}, statements())
+
+	err = db0.Find(&orders).Error
+	require.ErrorIs(t, err, ErrMissingShardingKey)
+
+	// the rows of user 2 live in another shard
+	err = db0.Where("user_id = ?", 1).Or("user_id = ?", 2).Find(&orders).Error
+	require.ErrorIs(t, err, ErrCrossShard)
+	err = db0.Where("user_id = ?", 1).Or("status = ?", "paid").Find(&orders).Error
+	require.ErrorIs(t, err, ErrMissingShardingKey)
+	err = db0.Not("user_id = ?", 1).Find(&orders).Error
+	require.ErrorIs(t, err, ErrCrossShard)
+	stmt = db0.Where("user_id = ?", 1).Or("user_id = ?", 5).Find(&orders).Statement
+	require.NoError(t, stmt.Error)
+	require.Equal(t, "SELECT * FROM `orders_1` WHERE user_id = ? OR user_id = ?", stmt.SQL.String())
+	stmt = db0.Where("user_id = ?", 2).Where(db0.Where("status = ?", "paid").Or("status = ?", "sent")).Find(&orders).Statement
+	require.NoError(t, stmt.Error)
+	require.Equal(t, "SELECT * FROM `orders_2` WHERE user_id = ? AND (status = ? OR status = ?)", stmt.SQL.String())
+
+	err = db0.Create(&[]shardingOrder{{UserID: 1}, {UserID: 2}}).Error
+	require.ErrorIs(t, err, ErrCrossShard)
+
+	// different keys of the same shard
+	require.NoError(t, db0.Create(&[]shardingOrder{{UserID: 1}, {UserID: 5}}).Error)
+	require.Equal(t, "INSERT INTO `orders_1` (`user_id`) VALUES (?),(?)", statements()[len(statements())-1])
+
+	shardDB, err := sharding.DB(context.Background(), int64(2))
+	require.NoError(t, err)
+	require.Equal(t, "orders_2", shardDB.Statement.Table)
+}
+
+func TestNewSharding(t *testing.T) {
+	db, _ := dryRunDB(t)
+	_, err := NewSharding("orders", "user_id", ShardingMod(0), []*gorm.DB{db})
+	require.EqualError(t, err, "gormbox: sharding orders has 0 shards, want a positive number")
+	_, err = NewSharding("orders", "user_id", ShardingMod(4), nil)
+	require.EqualError(t, err, "gormbox: sharding orders without dbs")
+	_, err = NewSharding("orders", "user_id", ShardingMod(1), []*gorm.DB{db, db})
+	require.EqualError(t, err, "gormbox: sharding orders has 2 dbs for 1 shards")
+}
+
+func TestShardingAlgorithms(t *testing.T) {
+	shard, err := ShardingMod(8).Shard("order-1")
+	require.NoError(t, err)
+	require.Less(t, shard, 8)
+
+	r := ShardingRange(1000, 100)
+	require.Equal(t, 3, r.Shards())
+	for key, expect := range map[int64]int{5: 0, 100: 1, 999: 1, 1000: 2, 50000: 2} {
+		shard, err = r.Shard(key)
+		require.NoError(t, err)
+		require.Equal(t, expect, shard, key)
+	}
+	_, err = r.Shard("x")
+	require.Error(t, err)
+
+	ch := ShardingConsistentHash(16, 64)
+	first, err := ch.Shard(uint(42))
+	require.NoError(t, err)
+	again, _ := ch.Shard(uint(42))
+	require.Equal(t, first, again)
+	require.Less(t, first, 16)
+}
+
+func TestInterceptorShardingTransaction(t *testing.T) {
+	db0, db1 := sqliteDB(t), sqliteDB(t)
+	for i, db := range []*gorm.DB{db0, db0, db1, db1} {
+		require.NoError(t, db.Table("orders_"+strconv.Itoa(i)).AutoMigrate(&shardingOrder{}))
+	}
+	// where the write would land keeping the connection of the implicit transaction
+	require.NoError(t, db0.Table("orders_3").AutoMigrate(&shardingOrder{}))
+	sharding, err := NewSharding("orders", "user_id", ShardingMod(4), []*gorm.DB{db0, db1})
+	require.NoError(t, err)
+	Intercept(db0, InterceptorSharding(&DSN{}, sharding))
+
+	// the implicit transaction of the write begins on db0
+	require.NoError(t, db0.Create(&shardingOrder{UserID: 3}).Error)
+	var count int64
+	require.NoError(t, db1.Table("orders_3").Count(&count).Error)
+	require.EqualValues(t, 1, count)
+	require.NoError(t, db0.Session(&gorm.Session{}).Table("orders_3").Count(&count).Error)
+	require.Zero(t, count)
+
+	require.NoError(t, db0.Where("user_id = ?", 3).Delete(&shardingOrder{}).Error)
+	require.NoError(t, db1.Table("orders_3").Count(&count).Error)
+	require.Zero(t, count)
+
+	err = db0.Transaction(func(tx *gorm.DB) error {
+		require.NoError(t, tx.Create(&shardingOrder{UserID: 1}).Error)
+		return tx.Create(&shardingOrder{UserID: 2}).Error
+	})
+	require.ErrorIs(t, err, ErrCrossShard)
+	require.NoError(t, db0.Table("orders_1").Count(&count).Error)
+	require.Zero(t, count)
+}
@@ -0,0 +1,177 @@
+package gormbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+	"reflect"
+	"strings"
+)
+
+var (
+	ErrMissingTenant  = errors.New("gormbox: tenant missing")
+	ErrTenantMismatch = errors.New("gormbox: record belongs to another tenant")
+)
+
+type tenantKey struct{}
+
+type tenantBypassKey struct{}
+
+// WithTenant scopes the statements issued with ctx to tenant, see OptionTenant.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+func TenantFrom(ctx context.Context) string {
+	if tenant, ok := ctx.Value(tenantKey{}).(string); ok {
+		return tenant
+	}
+	return ""
+}
+
+// WithoutTenant lets the statements issued with ctx run across tenants, e.g. for back office jobs.
+func WithoutTenant(ctx context.Context) context.Context {
+	return context.WithValue(ctx, tenantBypassKey{}, true)
+}
+
+func tenantBypassed(ctx context.Context) bool {
+	bypass, _ := ctx.Value(tenantBypassKey{}).(bool)
+	return bypass
+}
+
+// InterceptorTenant scopes the statements on the models having column to the tenant of the context.
+// Queries, updates and deletes get "column = tenant" added to their conditions, creates and updates get
+// column set and fail with ErrTenantMismatch when it holds another tenant. Updates and deletes without
+// conditions of their own fail as gorm fails them, before the tenant is added.
+// Statements without a tenant fail with ErrMissingTenant unless the context is WithoutTenant, raw
+// statements and tables without a model included, though these run unscoped with a tenant.
+func InterceptorTenant(column string) Interceptor {
+	return func(action string, next Handler) Handler {
+		return func(db *gorm.DB) {
+			stmt := db.Statement
+			ctx := stmt.Context
+			if db.Error != nil || ctx == nil || tenantBypassed(ctx) {
+				next(db)
+				return
+			}
+			var field *schema.Field
+			if stmt.Schema != nil && stmt.SQL.Len() == 0 && action != "gorm:raw" {
+				if field = stmt.Schema.LookUpField(column); field == nil {
+					next(db)
+					return
+				}
+			}
+
+			tenant := TenantFrom(ctx)
+			if tenant == "" {
+				table := stmt.Table
+				if table == "" {
+					table = strings.TrimPrefix(action, "gorm:")
+				}
+				_ = db.AddError(fmt.Errorf("%w: %s", ErrMissingTenant, table))
+				return
+			}
+			trace.SpanFromContext(ctx).SetAttributes(attribute.String("db.tenant", tenant))
+			if field == nil {
+				// the sql is the caller's to scope
+				next(db)
+				return
+			}
+
+			var err error
+			switch action {
+			case "gorm:create":
+				err = tenantSet(db, field, tenant, true)
+			case "gorm:update", "gorm:delete":
+				if !tenantConditions(db) {
+					err = gorm.ErrMissingWhereClause
+				} else if action == "gorm:update" {
+					err = tenantSet(db, field, tenant, false)
+				}
+			}
+			if err != nil {
+				_ = db.AddError(err)
+				return
+			}
+			if action != "gorm:create" {
+				stmt.AddClause(clause.Where{Exprs: []clause.Expression{
+					clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: field.DBName}, Value: tenant},
+				}})
+			}
+
+			next(db)
+		}
+	}
+}
+
+// tenantConditions tells whether an update or a delete has conditions of its own: a where clause or
+// the primary key of the record, unless the statement allows global updates.
+func tenantConditions(db *gorm.DB) bool {
+	stmt := db.Statement
+	if _, ok := stmt.Clauses["WHERE"]; ok || db.AllowGlobalUpdate {
+		return true
+	}
+	for _, rv := range []reflect.Value{stmt.ReflectValue, reflect.ValueOf(stmt.Dest)} {
+		if rv = reflect.Indirect(rv); rv.Kind() != reflect.Struct || rv.Type() != stmt.Schema.ModelType {
+			continue
+		}
+		if _, values := schema.GetIdentityFieldValuesMap(stmt.Context, rv, stmt.Schema.PrimaryFields); len(values) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// tenantSet fills the tenant of the records being written, records of another tenant are refused.
+// The maps of updates are only checked, the tenant is not added to their columns.
+func tenantSet(db *gorm.DB, field *schema.Field, tenant string, create bool) error {
+	if dest, ok := db.Statement.Dest.(map[string]interface{}); ok {
+		for _, key := range []string{field.DBName, field.Name} {
+			if value, ok := dest[key]; ok && fmt.Sprint(value) != tenant {
+				return fmt.Errorf("%w: %s=%v", ErrTenantMismatch, field.DBName, value)
+			}
+		}
+		if create {
+			dest[field.DBName] = tenant
+		}
+		return nil
+	}
+
+	set := func(rv reflect.Value) error {
+		value, zero := field.ValueOf(db.Statement.Context, rv)
+		if !zero {
+			if fmt.Sprint(value) != tenant {
+				return fmt.Errorf("%w: %s=%v", ErrTenantMismatch, field.DBName, value)
+			}
+			return nil
+		}
+		if !rv.CanAddr() {
+			return nil
+		}
+		return field.Set(db.Statement.Context, rv, tenant)
+	}
+
+	rv := reflect.Indirect(db.Statement.ReflectValue)
+	if !create {
+		// the values of an update, e.g. Save(&record) or Updates(&record)
+		if rv = reflect.Indirect(reflect.ValueOf(db.Statement.Dest)); rv.Kind() != reflect.Struct || rv.Type() != db.Statement.Schema.ModelType {
+			return nil
+		}
+	}
+	switch rv.Kind() {
+	case reflect.Struct:
+		return set(rv)
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			if err := set(reflect.Indirect(rv.Index(i))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
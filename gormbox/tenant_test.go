@@ -0,0 +1,95 @@
+package gormbox
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+	"testing"
+)
+
+type tenantOrder struct {
+	ID       int64
+	TenantID string
+	Amount   int64
+}
+
+func TestInterceptorTenant(t *testing.T) {
+	db, statements := dryRunDB(t)
+	Intercept(db, InterceptorTenant("tenant_id"))
+	ctx := WithTenant(context.Background(), "acme")
+
+	var orders []tenantOrder
+	stmt := db.WithContext(ctx).Where("amount > ?", 10).Find(&orders).Statement
+	require.NoError(t, stmt.Error)
+	require.Equal(t, "SELECT * FROM `tenant_orders` WHERE amount > ? AND `tenant_orders`.`tenant_id` = ?", stmt.SQL.String())
+	require.Equal(t, []interface{}{10, "acme"}, stmt.Vars)
+
+	stmt = db.WithContext(ctx).Model(&tenantOrder{}).Where("id = ?", 1).Update("amount", 20).Statement
+	require.NoError(t, stmt.Error)
+	require.Equal(t, "UPDATE `tenant_orders` SET `amount`=? WHERE id = ? AND `tenant_orders`.`tenant_id` = ?", stmt.SQL.String())
+
+	order := tenantOrder{ID: 1}
+	require.NoError(t, db.WithContext(ctx).Create(&order).Error)
+	require.Equal(t, "acme", order.TenantID)
+	require.Len(t, statements(), 1)
+
+	err := db.WithContext(ctx).Create(&tenantOrder{ID: 2, TenantID: "other"}).Error
+	require.ErrorIs(t, err, ErrTenantMismatch)
+
+	err = db.WithContext(context.Background()).Find(&orders).Error
+	require.ErrorIs(t, err, ErrMissingTenant)
+
+	stmt = db.WithContext(WithoutTenant(context.Background())).Find(&orders).Statement
+	require.NoError(t, stmt.Error)
+	require.Equal(t, "SELECT * FROM `tenant_orders`", stmt.SQL.String())
+}
+
+func TestInterceptorTenant_Conditions(t *testing.T) {
+	db, _ := dryRunDB(t)
+	Intercept(db, InterceptorTenant("tenant_id"))
+	ctx := WithTenant(context.Background(), "acme")
+
+	// the tenant is no condition of the delete
+	err := db.WithContext(ctx).Delete(&tenantOrder{}).Error
+	require.ErrorIs(t, err, gorm.ErrMissingWhereClause)
+	err = db.WithContext(ctx).Model(&tenantOrder{}).Update("amount", 1).Error
+	require.ErrorIs(t, err, gorm.ErrMissingWhereClause)
+
+	stmt := db.WithContext(ctx).Delete(&tenantOrder{ID: 1}).Statement
+	require.NoError(t, stmt.Error)
+	require.Equal(t, "DELETE FROM `tenant_orders` WHERE `tenant_orders`.`tenant_id` = ? AND `tenant_orders`.`id` = ?", stmt.SQL.String())
+
+	stmt = db.WithContext(ctx).Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(&tenantOrder{}).Statement
+	require.NoError(t, stmt.Error)
+	require.Equal(t, "DELETE FROM `tenant_orders` WHERE `tenant_orders`.`tenant_id` = ?", stmt.SQL.String())
+
+	// an update can't move a record to another tenant
+	err = db.WithContext(ctx).Model(&tenantOrder{}).Where("id = ?", 1).Update("tenant_id", "other").Error
+	require.ErrorIs(t, err, ErrTenantMismatch)
+	err = db.WithContext(ctx).Model(&tenantOrder{ID: 1}).Updates(map[string]interface{}{"TenantID": "other"}).Error
+	require.ErrorIs(t, err, ErrTenantMismatch)
+	err = db.WithContext(ctx).Save(&tenantOrder{ID: 1, TenantID: "other"}).Error
+	require.ErrorIs(t, err, ErrTenantMismatch)
+
+	order := tenantOrder{ID: 1, Amount: 5}
+	stmt = db.WithContext(ctx).Save(&order).Statement
+	require.NoError(t, stmt.Error)
+	require.Equal(t, "acme", order.TenantID)
+	require.Equal(t, "UPDATE `tenant_orders` SET `tenant_id`=?,`amount`=? WHERE `tenant_orders`.`tenant_id` = ? AND `id` = ?", stmt.SQL.String())
+}
+
+func TestInterceptorTenant_Raw(t *testing.T) {
+	db, _ := dryRunDB(t)
+	Intercept(db, InterceptorTenant("tenant_id"))
+
+	var orders []tenantOrder
+	err := db.Raw("SELECT * FROM tenant_orders").Scan(&orders).Error
+	require.ErrorIs(t, err, ErrMissingTenant)
+	err = db.Exec("DELETE FROM tenant_orders").Error
+	require.ErrorIs(t, err, ErrMissingTenant)
+	err = db.Table("tenant_orders").Find(&[]map[string]interface{}{}).Error
+	require.ErrorIs(t, err, ErrMissingTenant)
+
+	require.NoError(t, db.WithContext(WithTenant(context.Background(), "acme")).Exec("DELETE FROM tenant_orders WHERE tenant_id = ?", "acme").Error)
+	require.NoError(t, db.WithContext(WithoutTenant(context.Background())).Exec("DELETE FROM tenant_orders").Error)
+}
@@ -0,0 +1,178 @@
+package gormbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"reflect"
+)
+
+// mysql counts the placeholders of a prepared statement in 16 bits
+const upsertMaxPlaceholders = 65535
+
+var ErrUpsertUnsupported = errors.New("gormbox: upsert option unsupported by the dialect")
+
+type UpsertOption func(*upsertOptions)
+
+type upsertOptions struct {
+	conflict        []string
+	update          []string
+	maxPlaceholders int
+	operation       string
+}
+
+// UpsertOptionConflict is the unique key a row conflicts on. MySQL picks any conflicting unique key by itself,
+// it is required by the other dialects.
+func UpsertOptionConflict(columns ...string) UpsertOption {
+	return func(o *upsertOptions) { o.conflict = columns }
+}
+
+// UpsertOptionUpdate is the columns overwritten on conflict, every column but the conflict and primary key ones by default.
+func UpsertOptionUpdate(columns ...string) UpsertOption {
+	return func(o *upsertOptions) { o.update = columns }
+}
+
+// UpsertOptionMaxPlaceholders bounds the placeholders of one statement, rows are chunked to fit.
+func UpsertOptionMaxPlaceholders(n int) UpsertOption {
+	return func(o *upsertOptions) { o.maxPlaceholders = n }
+}
+
+// UpsertOptionOperation names the upsert when ctx has no operation, see WithOperation.
+func UpsertOptionOperation(operation string) UpsertOption {
+	return func(o *upsertOptions) { o.operation = operation }
+}
+
+// UpsertResult holds the rows affected by every chunk. MySQL counts 1 for an inserted row,
+// 2 for an updated one and 0 for a row left as it was.
+type UpsertResult struct {
+	RowsAffected []int64
+}
+
+func (r *UpsertResult) Total() int64 {
+	var total int64
+	for _, n := range r.RowsAffected {
+		total += n
+	}
+	return total
+}
+
+type upserter func(options *upsertOptions, update []string) ([]clause.Expression, error)
+
+var upserters = map[string]upserter{
+	DriverMysql:      upsertMysql,
+	DriverClickhouse: upsertClickhouse,
+}
+
+// INSERT ... ON DUPLICATE KEY UPDATE
+func upsertMysql(options *upsertOptions, update []string) ([]clause.Expression, error) {
+	return []clause.Expression{clause.OnConflict{DoUpdates: clause.AssignmentColumns(update)}}, nil
+}
+
+// clickhouse has no upsert, a ReplacingMergeTree keyed by its sorting key collapses the inserted duplicates,
+// so the conflict and update columns can't be chosen per statement
+func upsertClickhouse(options *upsertOptions, update []string) ([]clause.Expression, error) {
+	if len(options.conflict) > 0 || len(options.update) > 0 {
+		return nil, fmt.Errorf("%w: clickhouse takes neither conflict nor update columns", ErrUpsertUnsupported)
+	}
+	return nil, nil
+}
+
+// INSERT ... ON CONFLICT (...) DO UPDATE SET
+func upsertStandard(options *upsertOptions, update []string) ([]clause.Expression, error) {
+	columns := make([]clause.Column, 0, len(options.conflict))
+	for _, column := range options.conflict {
+		columns = append(columns, clause.Column{Name: column})
+	}
+	return []clause.Expression{clause.OnConflict{Columns: columns, DoUpdates: clause.AssignmentColumns(update)}}, nil
+}
+
+// Upsert inserts rows, a slice of models, updating the rows they conflict with in the dialect of db.
+// Rows are written in chunks bounded by the placeholders per statement, each chunk runs as operation
+// "<operation>.chunk" under an "<operation>" span. Chunks are not atomic, the chunks written before
+// a failing one stay written, run Upsert in a transaction when that matters.
+func Upsert(ctx context.Context, db *gorm.DB, rows interface{}, opts ...UpsertOption) (*UpsertResult, error) {
+	options := &upsertOptions{maxPlaceholders: upsertMaxPlaceholders, operation: "upsert"}
+	for _, opt := range opts {
+		opt(options)
+	}
+	result := &UpsertResult{}
+
+	rv := reflect.Indirect(reflect.ValueOf(rows))
+	if rv.Kind() != reflect.Slice {
+		return nil, fmt.Errorf("gormbox: upsert %T, want a slice", rows)
+	}
+	if rv.Len() == 0 {
+		return result, nil
+	}
+
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(rows); err != nil {
+		return nil, err
+	}
+	s := stmt.Schema
+	if len(s.DBNames) == 0 {
+		return nil, fmt.Errorf("gormbox: upsert %s without columns", s.Table)
+	}
+
+	update := options.update
+	if len(update) == 0 {
+		skip := make(map[string]bool, len(options.conflict))
+		for _, column := range options.conflict {
+			skip[column] = true
+		}
+		for _, field := range s.Fields {
+			if field.DBName != "" && field.Creatable && field.Updatable && !field.PrimaryKey && !skip[field.DBName] && field.AutoCreateTime == 0 {
+				update = append(update, field.DBName)
+			}
+		}
+	}
+	driver := db.Dialector.Name()
+	dialect, ok := upserters[driver]
+	if !ok {
+		dialect = upsertStandard
+	}
+	clauses, err := dialect(options, update)
+	if err != nil {
+		return nil, err
+	}
+
+	// counting every column, the ones gorm leaves out, e.g. a zero auto increment key, only make chunks smaller
+	size := options.maxPlaceholders / len(s.DBNames)
+	if size < 1 {
+		size = 1
+	}
+
+	operation := OperationFrom(ctx)
+	if operation == "" {
+		operation = options.operation
+	}
+	ctx, span := otel.Tracer(driver).Start(ctx, operation)
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("db.sql.table", s.Table),
+		attribute.Int("db.upsert.rows", rv.Len()),
+		attribute.Int("db.upsert.chunk_size", size),
+	)
+
+	chunkCtx := WithOperation(ctx, operation+".chunk")
+	for start := 0; start < rv.Len(); start += size {
+		end := start + size
+		if end > rv.Len() {
+			end = rv.Len()
+		}
+		tx := db.WithContext(chunkCtx).Clauses(clauses...).Create(rv.Slice(start, end).Interface())
+		if tx.Error != nil {
+			span.RecordError(tx.Error)
+			span.SetStatus(codes.Error, tx.Error.Error())
+			return result, tx.Error
+		}
+		result.RowsAffected = append(result.RowsAffected, tx.RowsAffected)
+	}
+	span.SetStatus(codes.Ok, "OK")
+	return result, nil
+}
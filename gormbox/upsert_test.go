@@ -0,0 +1,66 @@
+package gormbox
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/clickhouse"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"testing"
+)
+
+type upsertStock struct {
+	ID    int64
+	SKU   string `gorm:"uniqueIndex"`
+	Count int
+}
+
+func TestUpsert_Dialects(t *testing.T) {
+	ctx := context.Background()
+	stocks := []upsertStock{{SKU: "a", Count: 1}, {SKU: "b", Count: 2}, {SKU: "c", Count: 3}}
+
+	db, statements := dryRunDB(t)
+	result, err := Upsert(ctx, db, stocks, UpsertOptionConflict("sku"), UpsertOptionMaxPlaceholders(6))
+	require.NoError(t, err)
+	require.Len(t, result.RowsAffected, 2)
+	require.Equal(t, []string{
+		"INSERT INTO `upsert_stocks` (`sku`,`count`) VALUES (?,?),(?,?) ON DUPLICATE KEY UPDATE `count`=VALUES(`count`)",
+		"INSERT INTO `upsert_stocks` (`sku`,`count`) VALUES (?,?) ON DUPLICATE KEY UPDATE `count`=VALUES(`count`)",
+	}, statements())
+
+	db, err = gorm.Open(clickhouse.New(clickhouse.Config{DSN: "clickhouse://127.0.0.1:9000/test", SkipInitializeWithVersion: true}),
+		&gorm.Config{DryRun: true, DisableAutomaticPing: true, SkipDefaultTransaction: true})
+	require.NoError(t, err)
+	_, err = Upsert(ctx, db, stocks, UpsertOptionConflict("sku"))
+	require.ErrorIs(t, err, ErrUpsertUnsupported)
+	_, err = Upsert(ctx, db, stocks, UpsertOptionUpdate("count"))
+	require.ErrorIs(t, err, ErrUpsertUnsupported)
+	clauses, err := upsertClickhouse(&upsertOptions{}, []string{"count"})
+	require.NoError(t, err)
+	require.Empty(t, clauses)
+
+	clauses, err = upsertStandard(&upsertOptions{conflict: []string{"sku"}}, []string{"count"})
+	require.NoError(t, err)
+	require.Equal(t, []clause.Expression{clause.OnConflict{
+		Columns:   []clause.Column{{Name: "sku"}},
+		DoUpdates: clause.AssignmentColumns([]string{"count"}),
+	}}, clauses)
+}
+
+func TestUpsert_Sqlite(t *testing.T) {
+	db := sqliteDB(t)
+	require.NoError(t, db.AutoMigrate(&upsertStock{}))
+	require.NoError(t, db.Create(&upsertStock{SKU: "a", Count: 1}).Error)
+
+	result, err := Upsert(context.Background(), db,
+		[]upsertStock{{SKU: "a", Count: 5}, {SKU: "b", Count: 2}, {SKU: "c", Count: 3}},
+		UpsertOptionConflict("sku"), UpsertOptionMaxPlaceholders(6))
+	require.NoError(t, err)
+	require.Equal(t, []int64{2, 1}, result.RowsAffected)
+	require.Equal(t, int64(3), result.Total())
+
+	var stocks []upsertStock
+	require.NoError(t, db.Order("sku").Find(&stocks).Error)
+	require.Len(t, stocks, 3)
+	require.Equal(t, 5, stocks[0].Count)
+}